@@ -8,6 +8,8 @@ require (
 	github.com/diskfs/go-diskfs v1.4.1
 	github.com/google/uuid v1.3.1
 	github.com/klauspost/compress v1.17.4
+	github.com/pierrec/lz4/v4 v4.1.17
+	github.com/ulikunitz/xz v0.5.11
 	gvisor.dev/gvisor v0.0.0-20241012032629-122070c6678c
 	oras.land/oras-go/v2 v2.5.0
 )
@@ -17,10 +19,8 @@ require (
 	github.com/elliotwutingfeng/asciiset v0.0.0-20230602022725-51bbb787efab // indirect
 	github.com/opencontainers/go-digest v1.0.0 // indirect
 	github.com/opencontainers/image-spec v1.1.0 // indirect
-	github.com/pierrec/lz4/v4 v4.1.17 // indirect
 	github.com/pkg/xattr v0.4.9 // indirect
 	github.com/sirupsen/logrus v1.9.4-0.20230606125235-dd1b4c2e81af // indirect
-	github.com/ulikunitz/xz v0.5.11 // indirect
 	golang.org/x/sync v0.8.0 // indirect
 	golang.org/x/sys v0.26.0 // indirect
 	golang.org/x/time v0.7.0 // indirect
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/katexochen/image-tools/initrdsep/initrd"
+)
+
+// diff compares the initrds in the files at args[0] and args[1]. Segments are
+// matched by their index, entries within a segment by their path. Like
+// diff(1), it returns an error if the inputs differ.
+func diff(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: %s diff <path> <path>", os.Args[0])
+	}
+	setProgress(os.Stderr)
+
+	_, a, err := readSegments(args[0])
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", args[0], err)
+	}
+	_, b, err := readSegments(args[1])
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", args[1], err)
+	}
+
+	var differences int
+	for i := 0; i < max(len(a), len(b)); i++ {
+		prefix := fmt.Sprintf("initrd_%d", i)
+		switch {
+		case i >= len(b):
+			fmt.Printf("%s: only in %s\n", prefix, args[0])
+			differences++
+		case i >= len(a):
+			fmt.Printf("%s: only in %s\n", prefix, args[1])
+			differences++
+		default:
+			for _, line := range diffSegment(a[i], b[i]) {
+				fmt.Printf("%s: %s\n", prefix, line)
+				differences++
+			}
+		}
+	}
+	if differences > 0 {
+		return errors.New("initrds differ")
+	}
+	return nil
+}
+
+// cpioEntry is a cpio entry with the digest of its data.
+type cpioEntry struct {
+	hdr    *initrd.CPIOHeader
+	sha256 [sha256.Size]byte
+}
+
+// key identifies the entry within a segment. The same path may occur more
+// than once, for example if an archive is included twice, so the occurrence
+// is counted.
+func (e cpioEntry) key(occurrence int) string {
+	if occurrence == 1 {
+		return e.hdr.Name
+	}
+	return fmt.Sprintf("%s[#%d]", e.hdr.Name, occurrence)
+}
+
+// readSegments reads the entries of the cpio archives in every initrd in the
+// file at path.
+func readSegments(path string) ([]initrd.Segment, [][]cpioEntry, error) {
+	f, err := openInput(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var infos []initrd.Segment
+	var segments [][]cpioEntry
+	for seg, err := range initrd.NewReader(f).Segments() {
+		if err != nil {
+			return nil, nil, err
+		}
+		var entries []cpioEntry
+		if err := initrd.WalkCPIO(seg.Content, func(hdr *initrd.CPIOHeader, data io.Reader) error {
+			h := sha256.New()
+			if _, err := io.Copy(h, data); err != nil {
+				return fmt.Errorf("reading data of %s: %w", hdr.Name, err)
+			}
+			e := cpioEntry{hdr: hdr}
+			h.Sum(e.sha256[:0])
+			entries = append(entries, e)
+			return nil
+		}); err != nil {
+			return nil, nil, err
+		}
+		// The content has been read, so the segment is complete.
+		infos = append(infos, *seg)
+		segments = append(segments, entries)
+	}
+	return infos, segments, nil
+}
+
+// diffSegment describes the differences between the entries of two segments.
+func diffSegment(a, b []cpioEntry) []string {
+	keysA, entriesA := indexEntries(a)
+	keysB, entriesB := indexEntries(b)
+
+	var lines []string
+	for _, key := range keysA {
+		if _, ok := entriesB[key]; !ok {
+			lines = append(lines, "removed "+key)
+		}
+	}
+	for _, key := range keysB {
+		if _, ok := entriesA[key]; !ok {
+			lines = append(lines, "added "+key)
+		}
+	}
+
+	// Only the relative order of the entries present in both is compared,
+	// additions and removals don't count as reordering.
+	var commonA, commonB []string
+	for _, key := range keysA {
+		if _, ok := entriesB[key]; ok {
+			commonA = append(commonA, key)
+		}
+	}
+	posB := make(map[string]int)
+	for _, key := range keysB {
+		if _, ok := entriesA[key]; ok {
+			posB[key] = len(commonB)
+			commonB = append(commonB, key)
+		}
+	}
+
+	for i, key := range commonA {
+		ea, eb := entriesA[key], entriesB[key]
+		if ea.sha256 != eb.sha256 {
+			lines = append(lines, fmt.Sprintf("content %s: sha256 %x -> %x", key, ea.sha256, eb.sha256))
+		}
+		if changes := diffMetadata(ea.hdr, eb.hdr); len(changes) > 0 {
+			lines = append(lines, fmt.Sprintf("metadata %s: %s", key, strings.Join(changes, ", ")))
+		}
+		if j := posB[key]; j != i {
+			lines = append(lines, fmt.Sprintf("order %s: position %d -> %d", key, i, j))
+		}
+	}
+	return lines
+}
+
+// indexEntries returns the keys of the entries in archive order and the
+// entries by key.
+func indexEntries(entries []cpioEntry) ([]string, map[string]cpioEntry) {
+	keys := make([]string, 0, len(entries))
+	byKey := make(map[string]cpioEntry, len(entries))
+	occurrences := make(map[string]int)
+	for _, e := range entries {
+		occurrences[e.hdr.Name]++
+		key := e.key(occurrences[e.hdr.Name])
+		keys = append(keys, key)
+		byKey[key] = e
+	}
+	return keys, byKey
+}
+
+// diffMetadata describes the differences between the header fields of two
+// entries, except for the name and the fields derived from it or the data.
+func diffMetadata(a, b *initrd.CPIOHeader) []string {
+	var changes []string
+	field := func(name string, va, vb any) {
+		if va != vb {
+			changes = append(changes, fmt.Sprintf("%s %v -> %v", name, va, vb))
+		}
+	}
+	field("format", a.Format, b.Format)
+	field("mode", fmt.Sprintf("%06o", a.Mode), fmt.Sprintf("%06o", b.Mode))
+	field("uid", a.UID, b.UID)
+	field("gid", a.GID, b.GID)
+	field("nlink", a.Nlink, b.Nlink)
+	field("mtime", a.Mtime, b.Mtime)
+	field("ino", a.Ino, b.Ino)
+	field("dev", fmt.Sprintf("%d:%d", a.DevMajor, a.DevMinor), fmt.Sprintf("%d:%d", b.DevMajor, b.DevMinor))
+	field("rdev", fmt.Sprintf("%d:%d", a.RDevMajor, a.RDevMinor), fmt.Sprintf("%d:%d", b.RDevMajor, b.RDevMinor))
+	field("check", a.Check, b.Check)
+	return changes
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/katexochen/image-tools/initrdsep/initrd"
+)
+
+// dups reports initrds in the file at args[0] that duplicate each other,
+// completely or in part, and estimates the compressed bytes wasted on them.
+// Of identical initrds and of partly duplicated entries, the later copy is
+// counted as wasted. An initrd contained in another is wasted as a whole,
+// whether it comes before or after the one containing it.
+func dups(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s dups <path|->", os.Args[0])
+	}
+	setProgress(os.Stderr)
+
+	segments, entries, err := readSegments(args[0])
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", args[0], err)
+	}
+	findDuplicates(os.Stdout, segments, entries)
+	return nil
+}
+
+// findDuplicates writes a report about duplicated segments to w and returns
+// the total number of wasted compressed bytes.
+func findDuplicates(w io.Writer, segments []initrd.Segment, entries [][]cpioEntry) int64 {
+	wasted := make([]int64, len(segments))
+	waste := func(i int, n int64) {
+		wasted[i] = max(wasted[i], n)
+	}
+
+	// Identical segments are compared only once.
+	firstWithDigest := make(map[string]int)
+	var unique []int
+	for i, seg := range segments {
+		first, ok := firstWithDigest[seg.SHA256]
+		if !ok {
+			firstWithDigest[seg.SHA256] = i
+			unique = append(unique, i)
+			continue
+		}
+		fmt.Fprintf(w, "identical: initrd_%d is identical to initrd_%d (sha256 %s), wasting %d compressed bytes\n",
+			i, first, seg.SHA256, seg.CompressedSize)
+		waste(i, seg.CompressedSize)
+	}
+
+	for x, i := range unique {
+		for _, j := range unique[x+1:] {
+			o := compareEntries(entries[i], entries[j])
+			if o.commonPaths == 0 && o.commonContents == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "overlap: initrd_%d and initrd_%d share %d paths, %d identical entries and %d file contents\n",
+				i, j, o.commonPaths, o.identical, o.commonContents)
+
+			switch {
+			case o.identical == len(entries[j]) && len(entries[j]) > 0:
+				fmt.Fprintf(w, "subset: initrd_%d is contained in initrd_%d, wasting %d compressed bytes\n",
+					j, i, segments[j].CompressedSize)
+				waste(j, segments[j].CompressedSize)
+			case o.identical == len(entries[i]) && len(entries[i]) > 0:
+				fmt.Fprintf(w, "subset: initrd_%d is contained in initrd_%d, wasting %d compressed bytes\n",
+					i, j, segments[i].CompressedSize)
+				waste(i, segments[i].CompressedSize)
+			case o.identicalBytes > 0 && segments[j].Size > 0:
+				// Assume the duplicated data compresses like the rest
+				// of the segment.
+				n := segments[j].CompressedSize * o.identicalBytes / segments[j].Size
+				fmt.Fprintf(w, "partial: %d bytes of initrd_%d duplicate initrd_%d, wasting about %d compressed bytes\n",
+					o.identicalBytes, j, i, n)
+				waste(j, n)
+			}
+		}
+	}
+
+	var total int64
+	for _, n := range wasted {
+		total += n
+	}
+	fmt.Fprintf(w, "total: %d compressed bytes wasted\n", total)
+	return total
+}
+
+type entryOverlap struct {
+	// commonPaths is the number of paths present in both segments.
+	commonPaths int
+	// identical is the number of entries of the second segment that have
+	// an identical entry in the first, identicalBytes their size in the
+	// archive.
+	identical      int
+	identicalBytes int64
+	// commonContents is the number of distinct non-empty file contents
+	// present in both segments, regardless of the path.
+	commonContents int
+}
+
+// compareEntries compares the entries of segment a with those of b.
+func compareEntries(a, b []cpioEntry) entryOverlap {
+	type identity struct {
+		name   string
+		mode   uint32
+		sha256 [32]byte
+	}
+	paths := make(map[string]bool)
+	identities := make(map[identity]bool)
+	contents := make(map[[32]byte]bool)
+	for _, e := range a {
+		paths[e.hdr.Name] = true
+		identities[identity{e.hdr.Name, e.hdr.Mode, e.sha256}] = true
+		if e.hdr.FileSize > 0 {
+			contents[e.sha256] = true
+		}
+	}
+
+	var o entryOverlap
+	seenPaths := make(map[string]bool)
+	seenContents := make(map[[32]byte]bool)
+	for _, e := range b {
+		if paths[e.hdr.Name] && !seenPaths[e.hdr.Name] {
+			o.commonPaths++
+			seenPaths[e.hdr.Name] = true
+		}
+		if identities[identity{e.hdr.Name, e.hdr.Mode, e.sha256}] {
+			o.identical++
+			o.identicalBytes += entrySize(e.hdr)
+		}
+		if e.hdr.FileSize > 0 && contents[e.sha256] && !seenContents[e.sha256] {
+			o.commonContents++
+			seenContents[e.sha256] = true
+		}
+	}
+	return o
+}
+
+// entrySize returns the number of bytes an entry occupies in the archive.
+func entrySize(hdr *initrd.CPIOHeader) int64 {
+	align := hdr.Format.Alignment()
+	nameSize := hdr.Format.HeaderSize() + int64(hdr.NameSize)
+	return nameSize + initrd.PadTo(nameSize, align) + hdr.FileSize + initrd.PadTo(hdr.FileSize, align)
+}
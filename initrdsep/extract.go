@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/katexochen/image-tools/initrdsep/initrd"
+)
+
+// extractCPIO creates dir and extracts the cpio archives in r into it.
+func extractCPIO(r io.Reader, dir string) error {
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return err
+	}
+	x := &extractor{
+		dir:    dir,
+		links:  make(map[hardlinkKey]string),
+		asRoot: os.Geteuid() == 0,
+	}
+	if err := initrd.WalkCPIO(r, x.extract); err != nil {
+		return err
+	}
+	if err := x.finishDirs(); err != nil {
+		return err
+	}
+	fmt.Fprintf(progress, "extracted %d entries into %s\n", x.entries, dir)
+	return nil
+}
+
+// hardlinkKey identifies the inode of an entry, like the kernel does when
+// unpacking the initramfs in init/initramfs.c.
+type hardlinkKey struct {
+	ino      uint64
+	devMajor uint32
+	devMinor uint32
+	mode     uint32
+}
+
+type extractor struct {
+	dir    string
+	asRoot bool
+	// links maps inodes of regular files with multiple links to the path
+	// they were first extracted to.
+	links map[hardlinkKey]string
+	// dirs are the extracted directories. Their permissions and mtimes are
+	// applied at the end, as extracting their content would change them.
+	dirs    []*initrd.CPIOHeader
+	entries int
+}
+
+func (x *extractor) extract(hdr *initrd.CPIOHeader, data io.Reader) error {
+	path, err := x.securePath(hdr.Name)
+	if err != nil {
+		return err
+	}
+	x.entries++
+	if path == x.dir {
+		x.dirs = append(x.dirs, hdr)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("creating parent directory of %s: %w", hdr.Name, err)
+	}
+
+	// Later entries replace earlier ones of the same name, as in the kernel.
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.IsDir() && hdr.FileType() == initrd.CPIOModeDir {
+			x.dirs = append(x.dirs, hdr)
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("replacing %s: %w", hdr.Name, err)
+		}
+	}
+
+	switch hdr.FileType() {
+	case initrd.CPIOModeDir:
+		if err := os.Mkdir(path, 0o700); err != nil {
+			return fmt.Errorf("creating directory %s: %w", hdr.Name, err)
+		}
+		x.dirs = append(x.dirs, hdr)
+		return nil
+	case initrd.CPIOModeRegular:
+		if err := x.extractRegular(hdr, path, data); err != nil {
+			return err
+		}
+	case initrd.CPIOModeSymlink:
+		target, err := io.ReadAll(data)
+		if err != nil {
+			return fmt.Errorf("reading symlink target of %s: %w", hdr.Name, err)
+		}
+		if err := os.Symlink(string(target), path); err != nil {
+			return fmt.Errorf("creating symlink %s: %w", hdr.Name, err)
+		}
+		return x.chown(hdr, path)
+	case initrd.CPIOModeChar, initrd.CPIOModeBlock:
+		if x.asRoot {
+			dev := mkdev(hdr.RDevMajor, hdr.RDevMinor)
+			if err := syscall.Mknod(path, hdr.Mode, int(dev)); err != nil {
+				return fmt.Errorf("creating device node %s: %w", hdr.Name, err)
+			}
+			break
+		}
+		kind := "character"
+		if hdr.FileType() == initrd.CPIOModeBlock {
+			kind = "block"
+		}
+		placeholder := fmt.Sprintf("%s device %d:%d\n", kind, hdr.RDevMajor, hdr.RDevMinor)
+		return x.writePlaceholder(hdr, path, placeholder)
+	case initrd.CPIOModeFIFO:
+		if err := syscall.Mkfifo(path, hdr.Mode&0o7777); err != nil {
+			return fmt.Errorf("creating fifo %s: %w", hdr.Name, err)
+		}
+	case initrd.CPIOModeSocket:
+		return x.writePlaceholder(hdr, path, "socket\n")
+	default:
+		return fmt.Errorf("unknown file type %#o of %s", hdr.FileType(), hdr.Name)
+	}
+	return x.applyMetadata(hdr, path)
+}
+
+func (x *extractor) extractRegular(hdr *initrd.CPIOHeader, path string, data io.Reader) error {
+	// newc archives store the data of hard linked files only once, usually
+	// with the last link.
+	flags := os.O_CREATE | os.O_EXCL | os.O_WRONLY
+	var key hardlinkKey
+	if hdr.Nlink > 1 {
+		key = hardlinkKey{hdr.Ino, hdr.DevMajor, hdr.DevMinor, hdr.Mode}
+		if target, ok := x.links[key]; ok {
+			if err := os.Link(target, path); err != nil {
+				return fmt.Errorf("creating hard link %s: %w", hdr.Name, err)
+			}
+			if hdr.FileSize == 0 {
+				return nil
+			}
+			flags = os.O_WRONLY | os.O_TRUNC
+		}
+	}
+
+	f, err := os.OpenFile(path, flags|syscall.O_NOFOLLOW, 0o600)
+	if err != nil {
+		return fmt.Errorf("creating file %s: %w", hdr.Name, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, data); err != nil {
+		return fmt.Errorf("writing file %s: %w", hdr.Name, err)
+	}
+	if hdr.Nlink > 1 {
+		if _, ok := x.links[key]; !ok {
+			x.links[key] = path
+		}
+	}
+	return f.Close()
+}
+
+// writePlaceholder writes a regular file describing an entry that can't be
+// created without privileges.
+func (x *extractor) writePlaceholder(hdr *initrd.CPIOHeader, path, content string) error {
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		return fmt.Errorf("writing placeholder for %s: %w", hdr.Name, err)
+	}
+	return nil
+}
+
+func (x *extractor) applyMetadata(hdr *initrd.CPIOHeader, path string) error {
+	if err := x.chown(hdr, path); err != nil {
+		return err
+	}
+	if err := os.Chmod(path, fileMode(hdr.Mode)); err != nil {
+		return fmt.Errorf("setting mode of %s: %w", hdr.Name, err)
+	}
+	mtime := time.Unix(hdr.Mtime, 0)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		return fmt.Errorf("setting mtime of %s: %w", hdr.Name, err)
+	}
+	return nil
+}
+
+// chown sets the owner of path. This is only possible when running as root.
+func (x *extractor) chown(hdr *initrd.CPIOHeader, path string) error {
+	if !x.asRoot {
+		return nil
+	}
+	if err := os.Lchown(path, int(hdr.UID), int(hdr.GID)); err != nil {
+		return fmt.Errorf("setting owner of %s: %w", hdr.Name, err)
+	}
+	return nil
+}
+
+// finishDirs applies the metadata of the extracted directories, children
+// before their parents.
+func (x *extractor) finishDirs() error {
+	slices.SortStableFunc(x.dirs, func(a, b *initrd.CPIOHeader) int {
+		return strings.Count(b.Name, "/") - strings.Count(a.Name, "/")
+	})
+	for _, hdr := range x.dirs {
+		path, err := x.securePath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if err := x.applyMetadata(hdr, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// securePath returns the path an entry is extracted to. Entries must not
+// leave the target directory, neither by their name nor through a symlink
+// extracted earlier. Absolute names are treated relative to the target
+// directory, as the kernel unpacks them relative to the root.
+func (x *extractor) securePath(name string) (string, error) {
+	rel := strings.TrimLeft(name, "/")
+	if rel == "" {
+		rel = "."
+	}
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("entry %q points outside of the target directory", name)
+	}
+	rel = filepath.Clean(rel)
+	if rel == "." {
+		return x.dir, nil
+	}
+	parent := x.dir
+	for _, elem := range strings.Split(filepath.Dir(rel), string(filepath.Separator)) {
+		if elem == "." {
+			break
+		}
+		parent = filepath.Join(parent, elem)
+		fi, err := os.Lstat(parent)
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("entry %q is extracted through symlink %s", name, parent)
+		}
+	}
+	return filepath.Join(x.dir, rel), nil
+}
+
+// fileMode converts the permission bits of a cpio mode to an fs.FileMode.
+func fileMode(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode & 0o777)
+	if mode&0o4000 != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&0o2000 != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode&0o1000 != 0 {
+		m |= fs.ModeSticky
+	}
+	return m
+}
+
+// mkdev encodes a device number like the Linux makedev macro.
+func mkdev(major, minor uint32) uint64 {
+	return uint64(minor&0xff) | uint64(major&0xfff)<<8 |
+		uint64(minor&^0xff)<<12 | uint64(major&^0xfff)<<32
+}
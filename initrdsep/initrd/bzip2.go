@@ -0,0 +1,120 @@
+package initrd
+
+import (
+	"compress/bzip2"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// bzip2Decompressor decompresses a bzip2 stream.
+// https://github.com/dsnet/compress/blob/master/doc/bzip2-format.pdf
+//
+// compress/bzip2 doesn't report where the stream ended. After the
+// end-of-stream marker, it reads up to two more bytes to check for a
+// concatenated stream, and fails if there is none. The stream ends with a
+// 48 bit marker and a 32 bit checksum, padded to a full byte, so the end is
+// found by looking for the bit-aligned marker right before each possible end.
+// To not decompress a directly following bzip2 stream as part of this one,
+// bzip2StreamReader cuts the input at the next stream header.
+func bzip2Decompressor(in io.ReadSeeker, out io.Writer) error {
+	start, err := in.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("getting current position: %w", err)
+	}
+	var copyErr error
+	n, err := consumeCounting(in, func(cr *countingReader) error {
+		_, copyErr = io.Copy(out, bzip2.NewReader(&bzip2StreamReader{cr: cr}))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	overshoots := []int{0}
+	if copyErr != nil {
+		overshoots = []int{2, 1}
+	}
+	tailSize := min(int(n), 16)
+	tail, err := peekAt(in, -tailSize, tailSize)
+	if err != nil {
+		return fmt.Errorf("reading end of bzip2 stream: %w", err)
+	}
+	for _, overshoot := range overshoots {
+		if !bzip2HasEndMarker(tail[:tailSize-overshoot]) {
+			continue
+		}
+		if _, err := in.Seek(start+n-int64(overshoot), io.SeekStart); err != nil {
+			return fmt.Errorf("seeking end of bzip2 stream: %w", err)
+		}
+		fmt.Fprintln(Progress, "successfully decompressed bzip2")
+		return nil
+	}
+	if copyErr != nil {
+		return fmt.Errorf("decompressing bzip2: %w", copyErr)
+	}
+	return errors.New("bzip2 end-of-stream marker not found")
+}
+
+// bzip2StreamReader returns io.EOF when the next bytes are a bzip2 stream
+// header directly following the end of the previous stream.
+type bzip2StreamReader struct {
+	cr *countingReader
+	// recent holds the last bytes read, most recent last.
+	recent [16]byte
+}
+
+func (r *bzip2StreamReader) ReadByte() (byte, error) {
+	if next, err := r.cr.r.Peek(4); err == nil && string(next[:3]) == "BZh" && next[3] >= '1' && next[3] <= '9' {
+		if bzip2HasEndMarker(r.recent[max(0, len(r.recent)-int(r.cr.n)):]) {
+			return 0, io.EOF
+		}
+	}
+	b, err := r.cr.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	copy(r.recent[:], r.recent[1:])
+	r.recent[len(r.recent)-1] = b
+	return b, nil
+}
+
+// Read is only there to satisfy io.Reader, compress/bzip2 reads byte-wise
+// from an io.ByteReader.
+func (r *bzip2StreamReader) Read(p []byte) (int, error) {
+	for i := range p {
+		b, err := r.ReadByte()
+		if err != nil {
+			return i, err
+		}
+		p[i] = b
+	}
+	return len(p), nil
+}
+
+// bzip2HasEndMarker reports whether b ends with the bzip2 end-of-stream
+// marker, followed by the 32 bit stream checksum and less than a byte of
+// padding.
+func bzip2HasEndMarker(b []byte) bool {
+	const bzip2EndMarker = 0x177245385090
+	for padding := 0; padding < 8; padding++ {
+		pos := len(b)*8 - padding - 32 - 48
+		if pos < 0 {
+			return false
+		}
+		if readBits(b, pos, 48) == bzip2EndMarker {
+			return true
+		}
+	}
+	return false
+}
+
+// readBits reads n bits starting at bit offset pos of b, most significant
+// bit first.
+func readBits(b []byte, pos, n int) uint64 {
+	var v uint64
+	for i := pos; i < pos+n; i++ {
+		v = v<<1 | uint64(b[i/8]>>(7-i%8)&1)
+	}
+	return v
+}
@@ -0,0 +1,88 @@
+package initrd
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Kinds of initrd segments.
+const (
+	KindEarlyMicrocode = "early-microcode"
+	KindMain           = "main"
+	KindAddon          = "sysext-credentials"
+	KindFirmware       = "firmware"
+	KindUnknown        = "unknown"
+)
+
+// maxMicrocodeSize limits the size of microcode files read into memory.
+const maxMicrocodeSize = 64 << 20
+
+// classifySegment determines the kind of an initrd segment from the paths of
+// the cpio entries in r. Microcode updates in early microcode archives are
+// parsed. A segment that can't be read as cpio is of unknown kind.
+func classifySegment(r io.Reader) (string, []MicrocodeUpdate) {
+	var (
+		files, microcode, firmware, addon int
+		hasInit                           bool
+		updates                           []MicrocodeUpdate
+	)
+	if err := WalkCPIO(r, func(hdr *CPIOHeader, data io.Reader) error {
+		if hdr.FileType() == CPIOModeDir {
+			return nil
+		}
+		files++
+		name := strings.TrimPrefix(strings.TrimLeft(hdr.Name, "/"), "./")
+		switch {
+		case strings.HasPrefix(name, "kernel/x86/microcode/"):
+			microcode++
+			if hdr.FileType() != CPIOModeRegular {
+				return nil
+			}
+			var parse func([]byte) ([]MicrocodeUpdate, error)
+			switch name {
+			case "kernel/x86/microcode/GenuineIntel.bin":
+				parse = parseIntelMicrocode
+			case "kernel/x86/microcode/AuthenticAMD.bin":
+				parse = parseAMDMicrocode
+			default:
+				return nil
+			}
+			b, err := io.ReadAll(io.LimitReader(data, maxMicrocodeSize))
+			if err != nil {
+				return err
+			}
+			u, err := parse(b)
+			if err != nil {
+				fmt.Fprintf(Progress, "parsing %s: %v\n", name, err)
+			}
+			updates = append(updates, u...)
+		case strings.HasPrefix(name, "lib/firmware/"), strings.HasPrefix(name, "usr/lib/firmware/"):
+			firmware++
+		case strings.HasPrefix(name, ".extra/"):
+			// systemd-stub places system extensions, configuration
+			// extensions and credentials below /.extra.
+			addon++
+		case name == "init", name == "sbin/init", name == "usr/lib/systemd/systemd":
+			hasInit = true
+		}
+		return nil
+	}); err != nil {
+		return KindUnknown, nil
+	}
+
+	switch {
+	case hasInit:
+		return KindMain, updates
+	case files == 0:
+		return KindUnknown, nil
+	case microcode == files:
+		return KindEarlyMicrocode, updates
+	case firmware == files:
+		return KindFirmware, nil
+	case addon == files:
+		return KindAddon, nil
+	default:
+		return KindUnknown, updates
+	}
+}
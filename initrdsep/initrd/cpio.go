@@ -0,0 +1,483 @@
+package initrd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// CPIOTrailer is the name of the entry that ends a cpio archive.
+const CPIOTrailer = "TRAILER!!!"
+
+// cpioMaxNameSize is the largest name size, including the terminating NUL,
+// the kernel accepts in an initramfs, PATH_MAX.
+const cpioMaxNameSize = 4096
+
+// CPIOFormat is the header format of a cpio entry.
+// https://github.com/libyal/dtformats/blob/main/documentation/Copy%20in%20and%20out%20(CPIO)%20archive%20format.asciidoc
+type CPIOFormat string
+
+const (
+	CPIOFormatNewc     CPIOFormat = "newc"
+	CPIOFormatCRC      CPIOFormat = "crc"
+	CPIOFormatODC      CPIOFormat = "odc"
+	CPIOFormatBinaryLE CPIOFormat = "binary-le"
+	CPIOFormatBinaryBE CPIOFormat = "binary-be"
+)
+
+// Alignment returns the multiple the header and name as well as the data of
+// entries are padded to.
+func (f CPIOFormat) Alignment() int64 {
+	switch f {
+	case CPIOFormatNewc, CPIOFormatCRC:
+		return 4
+	case CPIOFormatBinaryLE, CPIOFormatBinaryBE:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// HeaderSize returns the size of the fixed part of the header.
+func (f CPIOFormat) HeaderSize() int64 {
+	switch f {
+	case CPIOFormatNewc, CPIOFormatCRC:
+		return 110
+	case CPIOFormatODC:
+		return 76
+	default:
+		return 26
+	}
+}
+
+// cpioHeaderSize returns the size of the fixed part of the header starting
+// with magic, or 0 if magic is unknown.
+func cpioHeaderSize(magic []byte) int {
+	switch {
+	case len(magic) < 6:
+		return 0
+	case string(magic[:6]) == "070701" || string(magic[:6]) == "070702":
+		return 110
+	case string(magic[:6]) == "070707":
+		return 76
+	case bytes.Equal(magic[:2], []byte{0x71, 0xc7}) || bytes.Equal(magic[:2], []byte{0xc7, 0x71}):
+		return 26
+	default:
+		return 0
+	}
+}
+
+// File type bits of the cpio mode field.
+const (
+	CPIOModeType    = 0o170000
+	CPIOModeSocket  = 0o140000
+	CPIOModeSymlink = 0o120000
+	CPIOModeRegular = 0o100000
+	CPIOModeBlock   = 0o060000
+	CPIOModeDir     = 0o040000
+	CPIOModeChar    = 0o020000
+	CPIOModeFIFO    = 0o010000
+)
+
+// CPIOHeader is a cpio entry header. Formats other than newc and crc store
+// fewer fields, the missing ones are zero.
+type CPIOHeader struct {
+	Format    CPIOFormat
+	Offset    int64 // Offset of the header in the uncompressed stream.
+	Ino       uint64
+	Mode      uint32
+	UID       uint32
+	GID       uint32
+	Nlink     uint32
+	Mtime     int64
+	FileSize  int64
+	DevMajor  uint32
+	DevMinor  uint32
+	RDevMajor uint32
+	RDevMinor uint32
+	NameSize  uint32
+	Check     uint32
+	Name      string
+}
+
+// FileType returns the file type bits of the mode, one of the CPIOMode constants.
+func (h *CPIOHeader) FileType() uint32 {
+	return h.Mode & CPIOModeType
+}
+
+// cpioReader reads the entries of cpio archives from a stream.
+type cpioReader struct {
+	r *bufio.Reader
+	// offset is the number of bytes consumed from r.
+	offset int64
+	// remaining is the number of unread data bytes of the current entry,
+	// padding is the number of padding bytes following them.
+	remaining int64
+	padding   int64
+	// tee, if set, receives all bytes consumed from r.
+	tee io.Writer
+}
+
+func newCPIOReader(r io.Reader) *cpioReader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &cpioReader{r: br}
+}
+
+// Next advances to the next entry of the archive. It returns io.EOF after the
+// trailer entry, which has been consumed at this point.
+func (r *cpioReader) Next() (*CPIOHeader, error) {
+	if err := r.skip(r.remaining + r.padding); err != nil {
+		return nil, fmt.Errorf("skipping to next cpio entry: %w", err)
+	}
+	r.remaining, r.padding = 0, 0
+
+	hdr, err := r.readHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	// The name is padded together with the header to a multiple of the
+	// alignment of the format.
+	align := hdr.Format.Alignment()
+	if hdr.NameSize == 0 || hdr.NameSize > cpioMaxNameSize {
+		return nil, fmt.Errorf("invalid cpio entry name size %d", hdr.NameSize)
+	}
+	name := make([]byte, hdr.NameSize)
+	if err := r.readFull(name); err != nil {
+		return nil, fmt.Errorf("reading cpio entry name: %w", err)
+	}
+	if err := r.skip(PadTo(r.offset-hdr.Offset, align)); err != nil {
+		return nil, fmt.Errorf("skipping cpio name padding: %w", err)
+	}
+	hdr.Name = string(bytes.TrimSuffix(name, []byte{0}))
+	r.remaining = hdr.FileSize
+	r.padding = PadTo(hdr.FileSize, align)
+
+	if hdr.Name == CPIOTrailer {
+		if err := r.skip(r.remaining + r.padding); err != nil {
+			return nil, fmt.Errorf("skipping cpio trailer: %w", err)
+		}
+		r.remaining, r.padding = 0, 0
+		return nil, io.EOF
+	}
+	return hdr, nil
+}
+
+// Read reads the data of the current entry.
+func (r *cpioReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.r.Read(p)
+	r.offset += int64(n)
+	r.remaining -= int64(n)
+	if r.tee != nil {
+		if _, err := r.tee.Write(p[:n]); err != nil {
+			return n, err
+		}
+	}
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextArchive skips the zero padding following the trailer of an archive and
+// reports whether another archive follows in the stream.
+func (r *cpioReader) nextArchive() (bool, error) {
+	for {
+		b, err := r.r.Peek(1)
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if b[0] != 0 {
+			return true, nil
+		}
+		if err := r.skip(1); err != nil {
+			return false, err
+		}
+	}
+}
+
+func (r *cpioReader) readHeader() (*CPIOHeader, error) {
+	hdr := &CPIOHeader{Offset: r.offset}
+	magic, err := r.r.Peek(6)
+	if err != nil {
+		return nil, fmt.Errorf("reading cpio magic: %w", err)
+	}
+
+	switch {
+	case string(magic) == "070701" || string(magic) == "070702":
+		hdr.Format = CPIOFormatNewc
+		if string(magic) == "070702" {
+			hdr.Format = CPIOFormatCRC
+		}
+		buf := make([]byte, 110)
+		if err := r.readFull(buf); err != nil {
+			return nil, fmt.Errorf("reading cpio header: %w", err)
+		}
+		var fields [13]uint64
+		for i := range fields {
+			if fields[i], err = parseCPIOInt(buf[6+i*8:14+i*8], 16); err != nil {
+				return nil, err
+			}
+		}
+		hdr.Ino = fields[0]
+		hdr.Mode = uint32(fields[1])
+		hdr.UID = uint32(fields[2])
+		hdr.GID = uint32(fields[3])
+		hdr.Nlink = uint32(fields[4])
+		hdr.Mtime = int64(fields[5])
+		hdr.FileSize = int64(fields[6])
+		hdr.DevMajor = uint32(fields[7])
+		hdr.DevMinor = uint32(fields[8])
+		hdr.RDevMajor = uint32(fields[9])
+		hdr.RDevMinor = uint32(fields[10])
+		hdr.NameSize = uint32(fields[11])
+		hdr.Check = uint32(fields[12])
+
+	case string(magic) == "070707":
+		hdr.Format = CPIOFormatODC
+		buf := make([]byte, 76)
+		if err := r.readFull(buf); err != nil {
+			return nil, fmt.Errorf("reading cpio header: %w", err)
+		}
+		var fields [10]uint64
+		for i, f := range []struct{ offset, size int }{
+			{6, 6}, {12, 6}, {18, 6}, {24, 6}, {30, 6}, {36, 6}, {42, 6}, {48, 11}, {59, 6}, {65, 11},
+		} {
+			if fields[i], err = parseCPIOInt(buf[f.offset:f.offset+f.size], 8); err != nil {
+				return nil, err
+			}
+		}
+		hdr.DevMajor, hdr.DevMinor = splitOldDev(fields[0])
+		hdr.Ino = fields[1]
+		hdr.Mode = uint32(fields[2])
+		hdr.UID = uint32(fields[3])
+		hdr.GID = uint32(fields[4])
+		hdr.Nlink = uint32(fields[5])
+		hdr.RDevMajor, hdr.RDevMinor = splitOldDev(fields[6])
+		hdr.Mtime = int64(fields[7])
+		hdr.NameSize = uint32(fields[8])
+		hdr.FileSize = int64(fields[9])
+
+	case bytes.Equal(magic[:2], []byte{0x71, 0xc7}) || bytes.Equal(magic[:2], []byte{0xc7, 0x71}):
+		// The binary format is written in the byte order of the machine
+		// that created it, which is detected from the magic.
+		var order binary.ByteOrder = binary.BigEndian
+		hdr.Format = CPIOFormatBinaryBE
+		if magic[0] == 0xc7 {
+			order = binary.LittleEndian
+			hdr.Format = CPIOFormatBinaryLE
+		}
+		buf := make([]byte, 26)
+		if err := r.readFull(buf); err != nil {
+			return nil, fmt.Errorf("reading cpio header: %w", err)
+		}
+		var fields [13]uint64
+		for i := range fields {
+			fields[i] = uint64(order.Uint16(buf[i*2:]))
+		}
+		hdr.DevMajor, hdr.DevMinor = splitOldDev(fields[1])
+		hdr.Ino = fields[2]
+		hdr.Mode = uint32(fields[3])
+		hdr.UID = uint32(fields[4])
+		hdr.GID = uint32(fields[5])
+		hdr.Nlink = uint32(fields[6])
+		hdr.RDevMajor, hdr.RDevMinor = splitOldDev(fields[7])
+		// 32 bit values are stored as two 16 bit words, most significant first.
+		hdr.Mtime = int64(fields[8]<<16 | fields[9])
+		hdr.NameSize = uint32(fields[10])
+		hdr.FileSize = int64(fields[11]<<16 | fields[12])
+
+	default:
+		return nil, fmt.Errorf("unknown cpio magic %s", hex.EncodeToString(magic))
+	}
+	return hdr, nil
+}
+
+func (r *cpioReader) readFull(p []byte) error {
+	n, err := io.ReadFull(r.r, p)
+	r.offset += int64(n)
+	if r.tee != nil {
+		if _, err := r.tee.Write(p[:n]); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (r *cpioReader) skip(n int64) error {
+	if r.tee != nil {
+		copied, err := io.CopyN(r.tee, r.r, n)
+		r.offset += copied
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	skipped, err := r.r.Discard(int(n))
+	r.offset += int64(skipped)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// WalkCPIO calls fn for every entry of the cpio archives in r. The archives
+// may be separated by zero padding. fn may read the entry data from data.
+func WalkCPIO(r io.Reader, fn func(hdr *CPIOHeader, data io.Reader) error) error {
+	cr := newCPIOReader(r)
+	for {
+		hdr, err := cr.Next()
+		if errors.Is(err, io.EOF) {
+			more, err := cr.nextArchive()
+			if err != nil {
+				return fmt.Errorf("looking for next cpio archive: %w", err)
+			}
+			if !more {
+				return nil
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := fn(hdr, cr); err != nil {
+			return err
+		}
+	}
+}
+
+// cpioBoundary follows the cpio archives written to it, to tell whether the
+// data written so far ends with a complete archive.
+type cpioBoundary struct {
+	// buf collects the header and name of the current entry.
+	buf        []byte
+	headerSize int
+	hdr        *CPIOHeader
+	// skip is the number of bytes of the current entry left to skip.
+	skip         int64
+	afterTrailer bool
+	invalid      bool
+}
+
+func (b *cpioBoundary) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 && !b.invalid {
+		if b.skip > 0 {
+			k := min(int64(len(p)), b.skip)
+			p = p[k:]
+			b.skip -= k
+			continue
+		}
+		if b.afterTrailer && len(b.buf) == 0 && p[0] == 0 {
+			// Padding after the archive.
+			p = p[1:]
+			continue
+		}
+		b.afterTrailer = false
+
+		want := 6
+		if b.hdr != nil {
+			want = b.headerSize + int(b.hdr.NameSize)
+		} else if b.headerSize != 0 {
+			want = b.headerSize
+		}
+		k := min(want-len(b.buf), len(p))
+		b.buf = append(b.buf, p[:k]...)
+		p = p[k:]
+		if len(b.buf) == want {
+			b.advance()
+		}
+	}
+	return n, nil
+}
+
+// advance parses the part of the entry collected in buf.
+func (b *cpioBoundary) advance() {
+	switch {
+	case b.headerSize == 0:
+		if b.headerSize = cpioHeaderSize(b.buf); b.headerSize == 0 {
+			b.invalid = true
+		}
+	case b.hdr == nil:
+		hdr, err := newCPIOReader(bytes.NewReader(b.buf)).readHeader()
+		if err != nil {
+			b.invalid = true
+			return
+		}
+		b.hdr = hdr
+		if hdr.NameSize == 0 {
+			b.advance()
+		}
+	default:
+		name := string(bytes.TrimSuffix(b.buf[b.headerSize:], []byte{0}))
+		align := b.hdr.Format.Alignment()
+		b.skip = PadTo(int64(len(b.buf)), align) + b.hdr.FileSize + PadTo(b.hdr.FileSize, align)
+		b.afterTrailer = name == CPIOTrailer
+		b.buf, b.headerSize, b.hdr = b.buf[:0], 0, nil
+	}
+}
+
+// atArchiveEnd reports whether the data written so far ends with a complete
+// cpio archive, possibly followed by zero padding.
+func (b *cpioBoundary) atArchiveEnd() bool {
+	return !b.invalid && b.afterTrailer && b.skip == 0 && len(b.buf) == 0
+}
+
+func parseCPIOInt(b []byte, base int) (uint64, error) {
+	i, err := strconv.ParseUint(string(b), base, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing cpio header field %q: %w", b, err)
+	}
+	return i, nil
+}
+
+// splitOldDev splits a device number of the old cpio formats into major and
+// minor number.
+func splitOldDev(dev uint64) (uint32, uint32) {
+	return uint32(dev >> 8), uint32(dev & 0xff)
+}
+
+// PadTo returns the number of bytes needed to pad n to a multiple of align.
+func PadTo(n, align int64) int64 {
+	return (align - n%align) % align
+}
+
+// WriteNewcEntry writes hdr and data as an entry of a newc archive. Only the
+// fields stored by newc are used, the name size and check are derived.
+func WriteNewcEntry(w io.Writer, hdr *CPIOHeader, data []byte) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		hdr.Ino, hdr.Mode, hdr.UID, hdr.GID, hdr.Nlink, hdr.Mtime, len(data),
+		hdr.DevMajor, hdr.DevMinor, hdr.RDevMajor, hdr.RDevMinor, len(hdr.Name)+1, 0)
+	b.WriteString(hdr.Name)
+	b.WriteByte(0)
+	b.Write(make([]byte, PadTo(int64(b.Len()), 4)))
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	_, err := w.Write(make([]byte, PadTo(int64(len(data)), 4)))
+	return err
+}
+
+// WriteNewcTrailer writes the trailer that ends a newc archive.
+func WriteNewcTrailer(w io.Writer) error {
+	return WriteNewcEntry(w, &CPIOHeader{Nlink: 1, Name: CPIOTrailer}, nil)
+}
@@ -0,0 +1,68 @@
+package initrd
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// gzipDecompressor decompresses a single gzip member. The member length isn't
+// stored anywhere in the gzip format, so the input is consumed through a
+// countingReader and repositioned right behind the member trailer afterwards.
+// If legacyMagic is set, the member starts with the old 1f9e magic, which is
+// otherwise identical to gzip.
+func gzipDecompressor(legacyMagic bool) decompressor {
+	return func(in io.ReadSeeker, out io.Writer) error {
+		_, err := consumeCounting(in, func(cr *countingReader) error {
+			var src flateReader = cr
+			if legacyMagic {
+				src = &legacyGzipReader{cr}
+			}
+			d, err := gzip.NewReader(src)
+			if err != nil {
+				return fmt.Errorf("reading gzip header: %w", err)
+			}
+			defer d.Close()
+			d.Multistream(false)
+			if _, err := io.Copy(out, d); err != nil {
+				return fmt.Errorf("decompressing gzip: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(Progress, "successfully decompressed gzip")
+		return nil
+	}
+}
+
+// flateReader is the interface compress/gzip uses without adding its own
+// buffering on top.
+type flateReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// legacyGzipReader rewrites the legacy gzip magic 1f9e to 1f8b on the fly.
+type legacyGzipReader struct {
+	*countingReader
+}
+
+func (l *legacyGzipReader) Read(p []byte) (int, error) {
+	off := l.n
+	n, err := l.countingReader.Read(p)
+	if off <= 1 && off+int64(n) > 1 {
+		p[1-off] = 0x8b
+	}
+	return n, err
+}
+
+func (l *legacyGzipReader) ReadByte() (byte, error) {
+	off := l.n
+	b, err := l.countingReader.ReadByte()
+	if err == nil && off == 1 {
+		b = 0x8b
+	}
+	return b, err
+}
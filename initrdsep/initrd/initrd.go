@@ -0,0 +1,392 @@
+// Package initrd separates files of concatenated initrds, as the kernel
+// accepts them, into the individual initrds. Initrds can be compressed in any
+// of the formats the kernel supports, or be uncompressed cpio archives.
+//
+//	r := initrd.NewReader(f)
+//	for seg, err := range r.Segments() {
+//		if err != nil {
+//			return err
+//		}
+//		if _, err := io.Copy(out, seg.Content); err != nil {
+//			return err
+//		}
+//	}
+package initrd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+)
+
+// Progress receives status messages about the detected formats and the
+// decompression.
+var Progress io.Writer = io.Discard
+
+// Segment describes an initrd in a file of concatenated initrds.
+type Segment struct {
+	Index int `json:"index"`
+	// Offset and CompressedSize locate the initrd in the file.
+	Offset         int64 `json:"offset"`
+	CompressedSize int64 `json:"compressedSize"`
+	// Padding is the number of zero bytes following the initrd.
+	Padding          int64  `json:"padding"`
+	Compression      string `json:"compression"`
+	Size             int64  `json:"size"`
+	CompressedSHA256 string `json:"compressedSha256"`
+	SHA256           string `json:"sha256"`
+	// Kind is the purpose of the initrd, determined from its content.
+	Kind      string            `json:"kind"`
+	Microcode []MicrocodeUpdate `json:"microcode,omitempty"`
+	// Frames and SkippableFrames count the frames of a zstd initrd.
+	Frames          int `json:"frames,omitempty"`
+	SkippableFrames int `json:"skippableFrames,omitempty"`
+
+	// Content is the decompressed initrd. It can only be read until the
+	// next segment is requested. The fields from CompressedSize on are set
+	// once Content is read to its end, which happens when the next segment
+	// is requested otherwise.
+	Content io.Reader `json:"-"`
+}
+
+// Reader reads the initrds of a file of concatenated initrds. The input
+// doesn't need to be seekable, so initrds can be read from pipes.
+type Reader struct {
+	in    *lookaheadReader
+	index int
+	// err ends the iteration after the current segment.
+	err error
+}
+
+// NewReader returns a Reader reading initrds from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{in: newLookaheadReader(r)}
+}
+
+// Segments returns an iterator over the initrds. Iteration stops at the end of
+// the input or at the first error, which is yielded with a nil segment.
+func (r *Reader) Segments() iter.Seq2[*Segment, error] {
+	return func(yield func(*Segment, error) bool) {
+		for r.err == nil {
+			seg, done, err := r.next()
+			if errors.Is(err, io.EOF) {
+				return
+			} else if err != nil {
+				r.err = err
+				yield(nil, err)
+				return
+			}
+			content := seg.Content.(*io.PipeReader)
+			cont := yield(seg, nil)
+			if !cont {
+				// Stop decompressing, and wait for it to finish before
+				// the input is used again.
+				content.CloseWithError(errors.New("iteration stopped"))
+			} else {
+				io.Copy(io.Discard, content)
+			}
+			if err := <-done; err != nil {
+				r.err = err
+				if cont {
+					yield(nil, err)
+				}
+				return
+			}
+			if !cont {
+				return
+			}
+		}
+	}
+}
+
+// Remaining returns a reader for the input from the current position on.
+// After an error, it starts at the first byte that couldn't be separated.
+func (r *Reader) Remaining() io.Reader {
+	return r.in
+}
+
+// InputDigest returns the size and sha256 of the input read so far. After the
+// iteration, this describes the whole input.
+func (r *Reader) InputDigest() (int64, []byte) {
+	return r.in.inputDigest()
+}
+
+// next starts decompressing the initrd at the current position. The returned
+// channel receives the result of decompressing, once the content is read.
+// It returns io.EOF at the end of the input.
+func (r *Reader) next() (*Segment, <-chan error, error) {
+	seg := &Segment{Index: r.index}
+	magic, err := peek(r.in, 2)
+	if err != nil {
+		return nil, nil, err
+	}
+	decompressor, compression, err := compressFormat(magic, seg)
+	if err != nil {
+		return nil, nil, err
+	}
+	seg.Compression = compression
+	if seg.Offset, err = r.in.Seek(0, io.SeekCurrent); err != nil {
+		return nil, nil, fmt.Errorf("getting current position: %w", err)
+	}
+	r.in.beginSegment()
+	r.index++
+
+	pr, pw := io.Pipe()
+	seg.Content = pr
+	done := make(chan error, 1)
+	go func() {
+		err := r.decompress(seg, decompressor, pw)
+		if err != nil {
+			// Decompressors stop anywhere on errors, the remaining
+			// input starts with the failed initrd.
+			if _, seekErr := r.in.Seek(seg.Offset, io.SeekStart); seekErr != nil {
+				err = errors.Join(err, fmt.Errorf("seeking back to the start of the initrd: %w", seekErr))
+			}
+		} else {
+			var padding int
+			padding, err = skipPadding(r.in)
+			seg.Padding = int64(padding)
+			if errors.Is(err, io.EOF) {
+				r.err, err = io.EOF, nil
+			} else if err != nil {
+				err = fmt.Errorf("skipping padding: %w", err)
+			}
+		}
+		// The segment is complete when its content ends.
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	return seg, done, nil
+}
+
+// decompress decompresses the initrd described by seg to out, and sets the
+// fields of seg describing it.
+func (r *Reader) decompress(seg *Segment, decompressor decompressor, out io.Writer) error {
+	h := sha256.New()
+	counter := &countingWriter{}
+	classifier := newPipeWriter(func(r io.Reader) error {
+		seg.Kind, seg.Microcode = classifySegment(r)
+		// Consume what classifying left unread.
+		_, err := io.Copy(io.Discard, r)
+		return err
+	})
+	if err := decompressor(r.in, io.MultiWriter(out, h, counter, classifier)); err != nil {
+		classifier.CloseWithError(err)
+		return err
+	}
+	if err := classifier.Close(); err != nil {
+		return fmt.Errorf("classifying initrd: %w", err)
+	}
+	seg.Size = counter.n
+	fmt.Fprintf(Progress, "initrd is of kind %s\n", seg.Kind)
+	for _, u := range seg.Microcode {
+		fmt.Fprintln(Progress, u)
+	}
+	seg.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	end, err := r.in.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("getting current position: %w", err)
+	}
+	seg.CompressedSize = end - seg.Offset
+	digest, err := r.in.segmentDigest()
+	if err != nil {
+		return fmt.Errorf("hashing compressed initrd: %w", err)
+	}
+	seg.CompressedSHA256 = hex.EncodeToString(digest)
+	return nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// compressFormat recognizes the compression format based on the magic bytes.
+// Based on https://elixir.bootlin.com/linux/v6.11.2/source/lib/decompress.c#L51-L61
+// It returns the decompressor and the name of the format. Decompressors
+// reporting details of the format set them in seg.
+func compressFormat(magic []byte, seg *Segment) (decompressor, string, error) {
+	if len(magic) < 2 {
+		return nil, "", fmt.Errorf("minimum magic length is 2")
+	}
+	if magic[0]&0xf0 == 0x50 && magic[1] == 0x2a {
+		fmt.Fprintln(Progress, "detected zstd compressed initrd starting with a skippable frame")
+		return zstdDecompressor(seg), "zstd", nil
+	}
+	switch hex.EncodeToString(magic) {
+	case "1f8b":
+		// https://www.rfc-editor.org/rfc/rfc1952
+		fmt.Fprintln(Progress, "detected gzip compressed initrd")
+		return gzipDecompressor(false), "gzip", nil
+	case "1f9e":
+		fmt.Fprintln(Progress, "detected legacy gzip compressed initrd")
+		return gzipDecompressor(true), "legacy-gzip", nil
+	case "425a":
+		fmt.Fprintln(Progress, "detected bzip2 compressed initrd")
+		return bzip2Decompressor, "bzip2", nil
+	case "5d00":
+		fmt.Fprintln(Progress, "detected lzma compressed initrd")
+		return lzmaDecompressor, "lzma", nil
+	case "fd37":
+		fmt.Fprintln(Progress, "detected xz compressed initrd")
+		return xzDecompressor, "xz", nil
+	case "894c":
+		fmt.Fprintln(Progress, "detected lzo compressed initrd")
+		return lzopDecompressor, "lzo", nil
+	case "0221":
+		fmt.Fprintln(Progress, "detected lz4 compressed initrd")
+		return lz4LegacyDecompressor, "lz4", nil
+	case "28b5":
+		// https://github.com/facebook/zstd/blob/dev/doc/zstd_compression_format.md
+		fmt.Fprintln(Progress, "detected zstd compressed initrd")
+		return zstdDecompressor(seg), "zstd", nil
+	case "3037":
+		// https://github.com/libyal/dtformats/blob/main/documentation/Copy%20in%20and%20out%20(CPIO)%20archive%20format.asciidoc
+		fmt.Fprintln(Progress, "detected uncompressed initrd in ascii cpio format")
+		return copyCPIO, "none", nil
+	case "c771", "71c7":
+		fmt.Fprintln(Progress, "detected uncompressed initrd in binary cpio format")
+		return copyCPIO, "none", nil
+	default:
+		return nil, "", fmt.Errorf("unknown magic bytes %s", hex.EncodeToString(magic))
+	}
+}
+
+type decompressor = func(io.ReadSeeker, io.Writer) error
+
+// copyCPIO copies a single uncompressed cpio archive up to and including its
+// trailer. Entries in the new ascii (newc), new ascii with checksum (crc),
+// portable ascii (odc) and old binary format in either byte order are
+// supported.
+func copyCPIO(in io.ReadSeeker, out io.Writer) error {
+	pos, err := in.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("getting current position: %w", err)
+	}
+	cr := newCPIOReader(in)
+	cr.tee = out
+	for {
+		if _, err := cr.Next(); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("copying cpio: %w", err)
+		}
+	}
+	// Undo the read-ahead of the cpio reader.
+	if _, err := in.Seek(pos+cr.offset, io.SeekStart); err != nil {
+		return fmt.Errorf("seeking behind cpio archive: %w", err)
+	}
+	fmt.Fprintln(Progress, "successfully copied uncompressed cpio archive")
+	return nil
+}
+
+func skipPadding(in io.ReadSeeker) (int, error) {
+	var skipped int
+	for {
+		b, err := peek(in, 1)
+		if err != nil {
+			return skipped, fmt.Errorf("reading single padding byte: %w", err)
+		}
+		if b[0] != 0 {
+			return skipped, nil
+		}
+		if _, err = in.Seek(1, io.SeekCurrent); err != nil {
+			return skipped, fmt.Errorf("skipping padding: %w", err)
+		}
+		skipped++
+	}
+}
+
+func peek(f io.ReadSeeker, n int) ([]byte, error) {
+	b := make([]byte, n)
+	read, err := io.ReadFull(f, b)
+	if _, err := f.Seek(-int64(read), io.SeekCurrent); err != nil {
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// peekAvailable is like peek, but returns fewer than n bytes if f ends
+// before.
+func peekAvailable(f io.ReadSeeker, n int) ([]byte, error) {
+	b := make([]byte, n)
+	read, err := io.ReadFull(f, b)
+	if _, err := f.Seek(-int64(read), io.SeekCurrent); err != nil {
+		return nil, err
+	}
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	return b[:read], nil
+}
+
+func peekAt(f io.ReadSeeker, offset, n int) ([]byte, error) {
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, fmt.Errorf("getting current position: %w", err)
+	}
+	defer f.Seek(pos, io.SeekStart)
+	if _, err := f.Seek(int64(offset), io.SeekCurrent); err != nil {
+		return nil, fmt.Errorf("seeking to offset %d: %w", offset, err)
+	}
+	return peek(f, n)
+}
+
+// countingReader counts the bytes consumed from a buffered reader. As it
+// implements io.ByteReader, decompressors like compress/flate don't add their
+// own read-ahead buffering on top, so the count is exact.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// unread hands back the last n consumed bytes, for decompressors that read
+// past the end of their stream in a known way.
+func (c *countingReader) unread(n int) {
+	c.n -= int64(n)
+}
+
+// consumeCounting calls fn with a countingReader starting at the current
+// position of in. Afterwards, in is positioned at the first byte fn didn't
+// consume, undoing the read-ahead of the buffer. It returns the number of
+// consumed bytes.
+func consumeCounting(in io.ReadSeeker, fn func(*countingReader) error) (int64, error) {
+	pos, err := in.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, fmt.Errorf("getting current position: %w", err)
+	}
+	cr := &countingReader{r: bufio.NewReader(in)}
+	if err := fn(cr); err != nil {
+		return cr.n, err
+	}
+	if _, err := in.Seek(pos+cr.n, io.SeekStart); err != nil {
+		return cr.n, fmt.Errorf("seeking behind consumed data: %w", err)
+	}
+	return cr.n, nil
+}
@@ -0,0 +1,486 @@
+package initrd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	it "github.com/katexochen/image-tools/internal/testing"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+func TestDecompressors(t *testing.T) {
+	content := bytes.Repeat([]byte("initrd content "), 1000)
+
+	testCases := map[string]struct {
+		compress     func(t *testing.T) []byte
+		decompressor decompressor
+	}{
+		"gzip": {
+			compress: func(t *testing.T) []byte {
+				return it.CompressWith(t, content, gzip.NewWriter)
+			},
+			decompressor: gzipDecompressor(false),
+		},
+		"legacy gzip": {
+			compress: func(t *testing.T) []byte {
+				b := it.CompressWith(t, content, gzip.NewWriter)
+				b[1] = 0x9e
+				return b
+			},
+			decompressor: gzipDecompressor(true),
+		},
+		"xz": {
+			compress: func(t *testing.T) []byte {
+				return it.CompressWith(t, content, func(w io.Writer) io.WriteCloser {
+					xw, err := xz.NewWriter(w)
+					if err != nil {
+						t.Fatal(err)
+					}
+					return xw
+				})
+			},
+			decompressor: xzDecompressor,
+		},
+		"lzma": {
+			compress: func(t *testing.T) []byte {
+				return it.CompressWith(t, content, func(w io.Writer) io.WriteCloser {
+					lw, err := lzma.NewWriter(w)
+					if err != nil {
+						t.Fatal(err)
+					}
+					return lw
+				})
+			},
+			decompressor: lzmaDecompressor,
+		},
+		"bzip2": {
+			compress: func(t *testing.T) []byte {
+				// There is no bzip2 compressor in Go, so this was created
+				// with `bzip2`.
+				return decodeHex(t, "425a6839314159265359c070fbbe000bb7918040000e21940020007041931026aa9ea0da99520d"+
+					"a90654836a419520ca9072a41ca9072a41b520da907d520f6a907b520fc5dc914e1424301c3eef80")
+			},
+			decompressor: bzip2Decompressor,
+		},
+		"lz4 legacy": {
+			compress: func(t *testing.T) []byte {
+				// The legacy writer of pierrec/lz4 always emits full
+				// 8 MiB chunks, so this was created with `lz4 -l`.
+				return decodeHex(t, "02214c1854000000ff00696e6974726420636f6e74656e74200f00"+
+					strings.Repeat("ff", 58)+"ab5074656e7420")
+			},
+			decompressor: lz4LegacyDecompressor,
+		},
+		"lzo": {
+			compress: func(t *testing.T) []byte {
+				// There is no lzo compressor in Go, so this was created
+				// with an lzop compatible encoder.
+				return decodeHex(t, "894c5a4f000d0a1a0a103020800940010500000003000081a40000000000000000"+
+					"0178292202d100003a98000000a99d178ad34461184920696e6974726420636f6e74656e7420200000393800"+
+					strings.Repeat("200000395c09", 23)+"2000002a5c0911000000000000")
+			},
+			decompressor: lzopDecompressor,
+		},
+		"zstd multiple frames": {
+			compress: func(t *testing.T) []byte {
+				skippable := binary.LittleEndian.AppendUint32(nil, 0x184d2a5e)
+				skippable = binary.LittleEndian.AppendUint32(skippable, 3)
+				return slices.Concat(
+					it.CompressWith(t, content[:5000], it.NewZstdWriter(t)),
+					append(skippable, "abc"...),
+					it.CompressWith(t, content[5000:], it.NewZstdWriter(t)),
+				)
+			},
+			decompressor: zstdDecompressor(&Segment{}),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			compressed := tc.compress(t)
+			streamSize := len(compressed)
+			// Padding and the start of the next
+			compressed = append(compressed, 0, 0, 0, 0, 0x28, 0xb5, 0x2f, 0xfd)
+
+			in := bytes.NewReader(compressed)
+			var out bytes.Buffer
+			if err := tc.decompressor(in, &out); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), content) {
+				t.Errorf("decompressed content doesn't match")
+			}
+			if pos, _ := in.Seek(0, io.SeekCurrent); pos != int64(streamSize) {
+				t.Errorf("got position %d after stream, want %d", pos, streamSize)
+			}
+		})
+	}
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestCopyCPIO(t *testing.T) {
+	entries := []it.CPIOEntry{
+		{Name: ".", Mode: 0o40755},
+		{Name: "etc", Mode: 0o40755},
+		{Name: "etc/hostname", Mode: 0o100644, Data: []byte("initrd\n")},
+		{Name: "bin", Mode: 0o120777, Data: []byte("usr/bin")},
+	}
+
+	testCases := map[string]struct {
+		archive []byte
+		wantErr bool
+	}{
+		"newc":                 {archive: it.NewcArchive(entries)},
+		"odc":                  {archive: it.ODCArchive(entries)},
+		"binary little endian": {archive: it.BinaryCPIOArchive(entries, binary.LittleEndian)},
+		"binary big endian":    {archive: it.BinaryCPIOArchive(entries, binary.BigEndian)},
+		"unknown magic":        {archive: []byte("070708" + strings.Repeat("0", 200)), wantErr: true},
+		"truncated":            {archive: it.NewcArchive(entries)[:200], wantErr: true},
+		"empty name":           {archive: withNewcNameSize(it.NewcArchive(entries), 0), wantErr: true},
+		"name too long":        {archive: withNewcNameSize(it.NewcArchive(entries), 0xffffffff), wantErr: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// Padding and the start of the next
+			in := bytes.NewReader(append(bytes.Clone(tc.archive), 0, 0, 0, 0, 0x28, 0xb5, 0x2f, 0xfd))
+			var out bytes.Buffer
+			err := copyCPIO(in, &out)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), tc.archive) {
+				t.Errorf("got %d bytes, want the %d bytes of the archive", out.Len(), len(tc.archive))
+			}
+			if pos, _ := in.Seek(0, io.SeekCurrent); pos != int64(len(tc.archive)) {
+				t.Errorf("got position %d, want %d", pos, len(tc.archive))
+			}
+		})
+	}
+}
+
+// withNewcNameSize returns a newc archive with the name size of the first
+// entry set to size.
+func withNewcNameSize(archive []byte, size uint32) []byte {
+	copy(archive[94:], fmt.Sprintf("%08x", size))
+	return archive
+}
+
+func TestSegments(t *testing.T) {
+	archive := it.NewcArchive([]it.CPIOEntry{{Name: "etc/hostname", Mode: 0o100644, Data: []byte("initrd\n")}})
+	compressed := it.CompressWith(t, archive, gzip.NewWriter)
+	in := slices.Concat(archive, compressed, make([]byte, 3), archive)
+
+	var segments []Segment
+	for seg, err := range NewReader(bytes.NewReader(in)).Segments() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(seg.Content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, archive) {
+			t.Errorf("content of segment %d doesn't match", seg.Index)
+		}
+		seg.Content = nil
+		segments = append(segments, *seg)
+	}
+
+	digest := func(b []byte) string {
+		sum := sha256.Sum256(b)
+		return hex.EncodeToString(sum[:])
+	}
+	n := int64(len(archive))
+	want := []Segment{
+		{Index: 0, Offset: 0, CompressedSize: n, Compression: "none", Size: n, Kind: KindUnknown,
+			CompressedSHA256: digest(archive), SHA256: digest(archive)},
+		{Index: 1, Offset: n, CompressedSize: int64(len(compressed)), Padding: 3, Compression: "gzip", Size: n, Kind: KindUnknown,
+			CompressedSHA256: digest(compressed), SHA256: digest(archive)},
+		{Index: 2, Offset: n + int64(len(compressed)) + 3, CompressedSize: n, Compression: "none", Size: n, Kind: KindUnknown,
+			CompressedSHA256: digest(archive), SHA256: digest(archive)},
+	}
+	if !reflect.DeepEqual(segments, want) {
+		t.Errorf("got segments\n%+v\nwant\n%+v", segments, want)
+	}
+}
+
+func TestSegmentsStop(t *testing.T) {
+	archive := it.NewcArchive([]it.CPIOEntry{{Name: "etc/hostname", Mode: 0o100644, Data: []byte("initrd\n")}})
+	in := slices.Concat(it.CompressWith(t, archive, gzip.NewWriter), []byte("garbage"))
+
+	r := NewReader(bytes.NewReader(in))
+	for range r.Segments() {
+		break
+	}
+	// Stopping aborts the unread segment, which ends the iteration.
+	for seg, err := range r.Segments() {
+		t.Fatalf("got segment %v, %v after stopping", seg, err)
+	}
+}
+
+func TestClassifySegment(t *testing.T) {
+	le32 := func(b []byte, vs ...uint32) []byte {
+		for _, v := range vs {
+			b = binary.LittleEndian.AppendUint32(b, v)
+		}
+		return b
+	}
+	// Intel header: version, revision, date, signature, checksum, loader
+	// version, platforms, data size, total size and reserved bytes.
+	intel := le32(nil, 1, 0xf8, 0x01102023, 0x906ea, 0, 1, 0x22, 0, 0)
+	intel = append(intel, make([]byte, 12+2000)...)
+	intel = le32(intel, 1, 0x2c, 0x12312022, 0x806c1, 0, 1, 0x80, 16, 48+16+20+24)
+	intel = append(intel, make([]byte, 12+16)...)
+	// Extended signature table: count, checksum, reserved and entries of
+	// signature, platforms and checksum.
+	intel = le32(intel, 2, 0, 0, 0, 0, 0x806c2, 0x80, 0, 0x806d1, 0x80, 0)
+
+	// AMD container: magic, equivalence table of an entry and a terminator,
+	// and a patch with date, revision and equivalence ID.
+	amd := le32(nil, 0x00414d44, 0, 32, 0x00a20f10, 0, 0, 0xa210, 0, 0, 0, 0)
+	amd = le32(amd, 1, 64, 0x03102023, 0x0a201210, 0, 0, 0, 0, 0xa210)
+	amd = append(amd, make([]byte, 64-28)...)
+
+	testCases := map[string]struct {
+		entries       []it.CPIOEntry
+		wantKind      string
+		wantMicrocode []MicrocodeUpdate
+	}{
+		"microcode": {
+			entries: []it.CPIOEntry{
+				{Name: "kernel", Mode: 0o40755},
+				{Name: "kernel/x86/microcode/GenuineIntel.bin", Mode: 0o100644, Data: intel},
+				{Name: "kernel/x86/microcode/AuthenticAMD.bin", Mode: 0o100644, Data: amd},
+			},
+			wantKind: KindEarlyMicrocode,
+			wantMicrocode: []MicrocodeUpdate{
+				{Vendor: "intel", Signatures: []uint32{0x906ea}, Platforms: 0x22, Revision: 0xf8, Date: "2023-01-10"},
+				{Vendor: "intel", Signatures: []uint32{0x806c1, 0x806c2, 0x806d1}, Platforms: 0x80, Revision: 0x2c, Date: "2022-12-31"},
+				{Vendor: "amd", Signatures: []uint32{0xa20f10}, Revision: 0x0a201210, Date: "2023-03-10"},
+			},
+		},
+		"main": {
+			entries: []it.CPIOEntry{
+				{Name: "usr/lib/firmware/a.bin", Mode: 0o100644},
+				{Name: "init", Mode: 0o120777, Data: []byte("usr/lib/systemd/systemd")},
+			},
+			wantKind: KindMain,
+		},
+		"firmware": {
+			entries:  []it.CPIOEntry{{Name: "usr/lib/firmware/a.bin", Mode: 0o100644}},
+			wantKind: KindFirmware,
+		},
+		"sysext": {
+			entries: []it.CPIOEntry{
+				{Name: ".extra/sysext/foo.raw", Mode: 0o100444},
+				{Name: ".extra/credentials/bar.cred", Mode: 0o100444},
+			},
+			wantKind: KindAddon,
+		},
+		"mixed": {
+			entries: []it.CPIOEntry{
+				{Name: "usr/lib/firmware/a.bin", Mode: 0o100644},
+				{Name: "etc/hostname", Mode: 0o100644},
+			},
+			wantKind: KindUnknown,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			kind, microcode := classifySegment(bytes.NewReader(it.NewcArchive(tc.entries)))
+			if kind != tc.wantKind {
+				t.Errorf("got kind %q, want %q", kind, tc.wantKind)
+			}
+			if !reflect.DeepEqual(microcode, tc.wantMicrocode) {
+				t.Errorf("got microcode %+v, want %+v", microcode, tc.wantMicrocode)
+			}
+		})
+	}
+}
+
+func TestLookaheadReader(t *testing.T) {
+	data := make([]byte, 5*maxLookbehind+123)
+	for i := range data {
+		data[i] = byte(i * 7 / 5)
+	}
+	segStart := int64(3 * maxLookbehind)
+
+	testCases := map[string]struct {
+		src io.Reader
+		// wantBehindErr is the error of seeking back before the segment
+		// start and beyond the buffer.
+		wantBehindErr error
+	}{
+		// Hide the Seek method of bytes.Reader.
+		"stream":   {src: struct{ io.Reader }{bytes.NewReader(data)}, wantBehindErr: errSeekBehindBuffer},
+		"seekable": {src: bytes.NewReader(data)},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			l := newLookaheadReader(tc.src)
+			if b, err := peek(l, 100); err != nil || !bytes.Equal(b, data[:100]) {
+				t.Fatalf("peek: got %v, %v", b, err)
+			}
+			if _, err := l.Seek(segStart, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			l.beginSegment()
+			if _, err := l.Seek(2*maxLookbehind, io.SeekCurrent); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := l.Seek(-maxLookbehind, io.SeekCurrent); err != nil {
+				t.Errorf("seeking back within the buffer: %v", err)
+			}
+			if _, err := l.Seek(100, io.SeekStart); !errors.Is(err, tc.wantBehindErr) {
+				t.Errorf("seeking back beyond the buffer: got %v, want %v", err, tc.wantBehindErr)
+			}
+			// A failed segment is rewound to its start.
+			if _, err := l.Seek(segStart, io.SeekStart); err != nil {
+				t.Fatalf("seeking back to the segment start: %v", err)
+			}
+
+			rest, err := io.ReadAll(l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rest, data[segStart:]) {
+				t.Error("read data differs from input")
+			}
+			if _, err := l.Seek(-10, io.SeekCurrent); err != nil {
+				t.Fatal(err)
+			}
+			digest, err := l.segmentDigest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := sha256.Sum256(data[segStart : len(data)-10]); !bytes.Equal(digest, want[:]) {
+				t.Errorf("got segment digest %x, want %x", digest, want)
+			}
+			size, digest := l.inputDigest()
+			if want := sha256.Sum256(data); size != int64(len(data)) || !bytes.Equal(digest, want[:]) {
+				t.Errorf("got input digest %x of %d bytes, want %x of %d bytes", digest, size, want, len(data))
+			}
+		})
+	}
+}
+
+func TestRemainingAfterLargeFailedSegment(t *testing.T) {
+	archive := it.NewcArchive([]it.CPIOEntry{{Name: "etc/hostname", Mode: 0o100644, Data: []byte("initrd\n")}})
+	// Incompressible content, so the truncated segment fails far more than
+	// maxLookbehind into the input.
+	content := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(content)
+	large := it.NewcArchive([]it.CPIOEntry{{Name: "data", Mode: 0o100644, Data: content}})
+	compressed := it.CompressWith(t, large, gzip.NewWriter)
+	truncated := compressed[:len(compressed)-100]
+
+	testCases := map[string]struct {
+		segment []byte
+	}{
+		"gzip":         {segment: truncated},
+		"uncompressed": {segment: large[:len(large)-200]},
+	}
+	for name, tc := range testCases {
+		in := slices.Concat(archive, tc.segment)
+		for srcName, src := range map[string]func() io.Reader{
+			"stream":   func() io.Reader { return struct{ io.Reader }{bytes.NewReader(in)} },
+			"seekable": func() io.Reader { return bytes.NewReader(in) },
+		} {
+			t.Run(name+"/"+srcName, func(t *testing.T) {
+				r := NewReader(src())
+				var iterErr error
+				for seg, err := range r.Segments() {
+					if err != nil {
+						iterErr = err
+						break
+					}
+					if _, err := io.Copy(io.Discard, seg.Content); err != nil && seg.Index == 0 {
+						t.Fatal(err)
+					}
+				}
+				if iterErr == nil {
+					t.Fatal("expected error")
+				}
+				remaining, err := io.ReadAll(r.Remaining())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(remaining, tc.segment) {
+					t.Errorf("got %d remaining bytes, want the %d bytes of the failed segment", len(remaining), len(tc.segment))
+				}
+			})
+		}
+	}
+}
+
+func TestZstdDecompressor(t *testing.T) {
+	archive := it.NewcArchive([]it.CPIOEntry{{Name: "etc/hostname", Mode: 0o100644, Data: []byte("initrd\n")}})
+
+	t.Run("frames of separate archives", func(t *testing.T) {
+		first := it.CompressWith(t, archive, it.NewZstdWriter(t))
+		in := bytes.NewReader(slices.Concat(first, it.CompressWith(t, archive, it.NewZstdWriter(t))))
+		var out bytes.Buffer
+		if err := zstdDecompressor(&Segment{})(in, &out); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), archive) {
+			t.Errorf("decompressed content doesn't match")
+		}
+		if pos, _ := in.Seek(0, io.SeekCurrent); pos != int64(len(first)) {
+			t.Errorf("got position %d after first archive, want %d", pos, len(first))
+		}
+	})
+
+	t.Run("frame count", func(t *testing.T) {
+		skippable := binary.LittleEndian.AppendUint32(nil, 0x184d2a50)
+		skippable = binary.LittleEndian.AppendUint32(skippable, 0)
+		in := slices.Concat(
+			skippable,
+			it.CompressWith(t, archive[:100], it.NewZstdWriter(t)),
+			it.CompressWith(t, archive[100:], it.NewZstdWriter(t)),
+		)
+		var seg Segment
+		if err := zstdDecompressor(&seg)(bytes.NewReader(in), io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		if seg.Frames != 2 || seg.SkippableFrames != 1 {
+			t.Errorf("got %d frames and %d skippable frames, want 2 and 1", seg.Frames, seg.SkippableFrames)
+		}
+	})
+
+	t.Run("content checksum mismatch", func(t *testing.T) {
+		compressed := it.CompressWith(t, archive, it.NewZstdWriter(t, zstd.WithEncoderCRC(true)))
+		compressed[len(compressed)-1] ^= 0xff
+		if err := zstdDecompressor(&Segment{})(bytes.NewReader(compressed), io.Discard); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
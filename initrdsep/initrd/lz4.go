@@ -0,0 +1,73 @@
+package initrd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// lz4LegacyDecompressor decompresses an lz4 stream in the legacy format, as
+// used by the kernel for CONFIG_RD_LZ4.
+// https://github.com/lz4/lz4/blob/dev/doc/lz4_Frame_format.md#legacy-frame
+//
+// The legacy format is a sequence of chunks, each prefixed with its compressed
+// size, and has no end marker. Every chunk except the last one decompresses to
+// exactly 8 MiB, so the stream ends after the first shorter chunk. Otherwise,
+// like the kernel in lib/decompress_unlz4.c, the stream ends at the end of
+// the input or at zero padding. A chunk size that can't be valid is treated
+// as the start of the next initrd.
+func lz4LegacyDecompressor(in io.ReadSeeker, out io.Writer) error {
+	const lz4LegacyMagic = 0x184c2102
+	const lz4LegacyChunkSize = 8 << 20
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(in, buf); err != nil {
+		return fmt.Errorf("reading lz4 magic: %w", err)
+	}
+	if binary.LittleEndian.Uint32(buf) != lz4LegacyMagic {
+		return fmt.Errorf("invalid lz4 legacy magic %x", buf)
+	}
+
+	src := make([]byte, lz4.CompressBlockBound(lz4LegacyChunkSize))
+	dst := make([]byte, lz4LegacyChunkSize)
+	for {
+		sizeBytes, err := peek(in, 4)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("reading lz4 chunk size: %w", err)
+		}
+		chunkSize := binary.LittleEndian.Uint32(sizeBytes)
+		if chunkSize == lz4LegacyMagic {
+			// Concatenated legacy streams may repeat the magic.
+			if _, err := in.Seek(4, io.SeekCurrent); err != nil {
+				return fmt.Errorf("skipping lz4 magic: %w", err)
+			}
+			continue
+		}
+		if chunkSize == 0 || int(chunkSize) > len(src) {
+			break
+		}
+		if _, err := in.Seek(4, io.SeekCurrent); err != nil {
+			return fmt.Errorf("skipping lz4 chunk size: %w", err)
+		}
+		if _, err := io.ReadFull(in, src[:chunkSize]); err != nil {
+			return fmt.Errorf("reading lz4 chunk: %w", err)
+		}
+		n, err := lz4.UncompressBlock(src[:chunkSize], dst)
+		if err != nil {
+			return fmt.Errorf("decompressing lz4 chunk: %w", err)
+		}
+		if _, err := out.Write(dst[:n]); err != nil {
+			return fmt.Errorf("writing lz4 chunk: %w", err)
+		}
+		if n < lz4LegacyChunkSize {
+			break
+		}
+	}
+	fmt.Fprintln(Progress, "successfully decompressed lz4")
+	return nil
+}
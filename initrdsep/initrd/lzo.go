@@ -0,0 +1,363 @@
+package initrd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"io"
+)
+
+// lzop header flags.
+// https://github.com/nemequ/lzop/blob/master/src/conf.h
+const (
+	lzopFlagAdler32D   = 0x0001
+	lzopFlagAdler32C   = 0x0002
+	lzopFlagExtraField = 0x0040
+	lzopFlagCRC32D     = 0x0100
+	lzopFlagCRC32C     = 0x0200
+	lzopFlagFilter     = 0x0800
+	lzopFlagCRC32      = 0x1000
+)
+
+// lzopDecompressor decompresses a file in the lzop format, which the kernel
+// uses for CONFIG_RD_LZO. The lzop block sequence is terminated by a block
+// with an uncompressed size of zero, which marks the end of the stream.
+func lzopDecompressor(in io.ReadSeeker, out io.Writer) error {
+	flags, err := lzopReadHeader(in)
+	if err != nil {
+		return fmt.Errorf("reading lzop header: %w", err)
+	}
+
+	for {
+		var dstLen uint32
+		if err := binary.Read(in, binary.BigEndian, &dstLen); err != nil {
+			return fmt.Errorf("reading lzop block size: %w", err)
+		}
+		if dstLen == 0 {
+			break
+		}
+		if dstLen > 64<<20 {
+			return fmt.Errorf("lzop block size %d is too large", dstLen)
+		}
+		var srcLen uint32
+		if err := binary.Read(in, binary.BigEndian, &srcLen); err != nil {
+			return fmt.Errorf("reading lzop compressed block size: %w", err)
+		}
+		if srcLen > dstLen {
+			return fmt.Errorf("lzop compressed block size %d exceeds block size %d", srcLen, dstLen)
+		}
+
+		var dChecksums, cChecksums []lzopChecksum
+		for _, c := range []struct {
+			flag     uint32
+			newHash  func() hash.Hash32
+			checksum *[]lzopChecksum
+		}{
+			{lzopFlagAdler32D, adler32.New, &dChecksums},
+			{lzopFlagCRC32D, crc32.NewIEEE, &dChecksums},
+			{lzopFlagAdler32C, adler32.New, &cChecksums},
+			{lzopFlagCRC32C, crc32.NewIEEE, &cChecksums},
+		} {
+			if flags&c.flag == 0 {
+				continue
+			}
+			// Checksums of the compressed data are only stored for
+			// compressed blocks.
+			if c.checksum == &cChecksums && srcLen == dstLen {
+				continue
+			}
+			var want uint32
+			if err := binary.Read(in, binary.BigEndian, &want); err != nil {
+				return fmt.Errorf("reading lzop block checksum: %w", err)
+			}
+			*c.checksum = append(*c.checksum, lzopChecksum{c.newHash, want})
+		}
+
+		src := make([]byte, srcLen)
+		if _, err := io.ReadFull(in, src); err != nil {
+			return fmt.Errorf("reading lzop block: %w", err)
+		}
+		if err := lzopVerify(cChecksums, src); err != nil {
+			return fmt.Errorf("verifying compressed lzop block: %w", err)
+		}
+		dst := src
+		if srcLen < dstLen {
+			dst, err = lzo1xDecompress(src, int(dstLen))
+			if err != nil {
+				return fmt.Errorf("decompressing lzo block: %w", err)
+			}
+		}
+		if err := lzopVerify(dChecksums, dst); err != nil {
+			return fmt.Errorf("verifying lzop block: %w", err)
+		}
+		if _, err := out.Write(dst); err != nil {
+			return fmt.Errorf("writing lzo block: %w", err)
+		}
+	}
+	fmt.Fprintln(Progress, "successfully decompressed lzo")
+	return nil
+}
+
+// lzopReadHeader reads and verifies the lzop file header and returns its flags.
+func lzopReadHeader(in io.Reader) (uint32, error) {
+	lzopMagic := []byte{0x89, 'L', 'Z', 'O', 0x00, 0x0d, 0x0a, 0x1a, 0x0a}
+	magic := make([]byte, len(lzopMagic))
+	if _, err := io.ReadFull(in, magic); err != nil {
+		return 0, fmt.Errorf("reading magic: %w", err)
+	}
+	if !bytes.Equal(magic, lzopMagic) {
+		return 0, fmt.Errorf("invalid magic %x", magic)
+	}
+
+	// The header checksum covers everything after the magic up to the
+	// checksum itself, so record what we read.
+	var header bytes.Buffer
+	r := io.TeeReader(in, &header)
+	read := func(n int) ([]byte, error) {
+		b := make([]byte, n)
+		_, err := io.ReadFull(r, b)
+		return b, err
+	}
+
+	fixed, err := read(4)
+	if err != nil {
+		return 0, fmt.Errorf("reading version: %w", err)
+	}
+	version := binary.BigEndian.Uint16(fixed)
+	// Version needed to extract and compression level were added in 0.94.
+	skip := 1 // method
+	if version >= 0x0940 {
+		skip += 3
+	}
+	if _, err := read(skip); err != nil {
+		return 0, fmt.Errorf("reading method: %w", err)
+	}
+	b, err := read(4)
+	if err != nil {
+		return 0, fmt.Errorf("reading flags: %w", err)
+	}
+	flags := binary.BigEndian.Uint32(b)
+	skip = 8 // mode, mtime low
+	if flags&lzopFlagFilter != 0 {
+		skip += 4
+	}
+	if version >= 0x0940 {
+		skip += 4 // mtime high
+	}
+	if _, err := read(skip); err != nil {
+		return 0, fmt.Errorf("reading mode and mtime: %w", err)
+	}
+	nameLen, err := read(1)
+	if err != nil {
+		return 0, fmt.Errorf("reading name length: %w", err)
+	}
+	if _, err := read(int(nameLen[0])); err != nil {
+		return 0, fmt.Errorf("reading name: %w", err)
+	}
+
+	var headerHash hash.Hash32 = adler32.New()
+	if flags&lzopFlagCRC32 != 0 {
+		headerHash = crc32.NewIEEE()
+	}
+	headerHash.Write(header.Bytes())
+	var want uint32
+	if err := binary.Read(in, binary.BigEndian, &want); err != nil {
+		return 0, fmt.Errorf("reading header checksum: %w", err)
+	}
+	if got := headerHash.Sum32(); got != want {
+		return 0, fmt.Errorf("header checksum mismatch: got %08x, want %08x", got, want)
+	}
+
+	if flags&lzopFlagExtraField != 0 {
+		var extraLen uint32
+		if err := binary.Read(in, binary.BigEndian, &extraLen); err != nil {
+			return 0, fmt.Errorf("reading extra field length: %w", err)
+		}
+		// Extra field data and its checksum.
+		if _, err := io.CopyN(io.Discard, in, int64(extraLen)+4); err != nil {
+			return 0, fmt.Errorf("reading extra field: %w", err)
+		}
+	}
+	return flags, nil
+}
+
+type lzopChecksum struct {
+	newHash func() hash.Hash32
+	want    uint32
+}
+
+func lzopVerify(checksums []lzopChecksum, data []byte) error {
+	for _, c := range checksums {
+		h := c.newHash()
+		h.Write(data)
+		if got := h.Sum32(); got != c.want {
+			return fmt.Errorf("checksum mismatch: got %08x, want %08x", got, c.want)
+		}
+	}
+	return nil
+}
+
+var errLZOCorrupt = errors.New("corrupt lzo1x data")
+
+// lzo1xDecompress decompresses a single LZO1X block of dstLen bytes.
+// Port of lzo1x_decompress_safe from the kernel (lib/lzo/lzo1x_decompress_safe.c),
+// without the LZO-RLE extension.
+func lzo1xDecompress(src []byte, dstLen int) ([]byte, error) {
+	const m2MaxOffset = 0x0800
+
+	dst := make([]byte, 0, dstLen)
+	var ip int
+
+	next := func() (int, error) {
+		if ip >= len(src) {
+			return 0, errLZOCorrupt
+		}
+		ip++
+		return int(src[ip-1]), nil
+	}
+	le16 := func() (int, error) {
+		if ip+2 > len(src) {
+			return 0, errLZOCorrupt
+		}
+		ip += 2
+		return int(binary.LittleEndian.Uint16(src[ip-2:])), nil
+	}
+	// runLength decodes the length of a long literal run or match, which is
+	// encoded as a number of zero bytes, each worth 255, and a final byte.
+	runLength := func(base int) (int, error) {
+		var zeros int
+		for ip < len(src) && src[ip] == 0 {
+			zeros++
+			ip++
+		}
+		b, err := next()
+		if err != nil {
+			return 0, err
+		}
+		return base + zeros*255 + b, nil
+	}
+	copyLiterals := func(n int) error {
+		if ip+n > len(src) || len(dst)+n > dstLen {
+			return errLZOCorrupt
+		}
+		dst = append(dst, src[ip:ip+n]...)
+		ip += n
+		return nil
+	}
+	copyMatch := func(dist, n int) error {
+		m := len(dst) - dist
+		if m < 0 || len(dst)+n > dstLen {
+			return errLZOCorrupt
+		}
+		// Matches may overlap their own output, so copy byte by byte.
+		for i := 0; i < n; i++ {
+			dst = append(dst, dst[m+i])
+		}
+		return nil
+	}
+
+	// state is the number of literals copied after the last instruction,
+	// with 4 meaning 4 or more.
+	var state int
+	if len(src) > 0 && src[0] > 17 {
+		ip++
+		t := int(src[0]) - 17
+		if err := copyLiterals(t); err != nil {
+			return nil, err
+		}
+		state = min(t, 4)
+	}
+
+	for {
+		t, err := next()
+		if err != nil {
+			return nil, err
+		}
+
+		var dist, length, trailing int
+		switch {
+		case t < 16 && state == 0:
+			// Literal run.
+			length = t + 3
+			if t == 0 {
+				if length, err = runLength(15 + 3); err != nil {
+					return nil, err
+				}
+			}
+			if err := copyLiterals(length); err != nil {
+				return nil, err
+			}
+			state = 4
+			continue
+		case t < 16:
+			// Short match directly after a literal run.
+			b, err := next()
+			if err != nil {
+				return nil, err
+			}
+			dist = 1 + t>>2 + b<<2
+			length = 2
+			if state == 4 {
+				dist += m2MaxOffset
+				length = 3
+			}
+			trailing = t & 3
+		case t >= 64:
+			// M2 match.
+			b, err := next()
+			if err != nil {
+				return nil, err
+			}
+			dist = 1 + (t>>2)&7 + b<<3
+			length = t>>5 + 1
+			trailing = t & 3
+		case t >= 32:
+			// M3 match.
+			length = t&31 + 2
+			if length == 2 {
+				if length, err = runLength(31 + 2); err != nil {
+					return nil, err
+				}
+			}
+			v, err := le16()
+			if err != nil {
+				return nil, err
+			}
+			dist = 1 + v>>2
+			trailing = v & 3
+		default:
+			// M4 match or end of stream.
+			length = t&7 + 2
+			if length == 2 {
+				if length, err = runLength(7 + 2); err != nil {
+					return nil, err
+				}
+			}
+			v, err := le16()
+			if err != nil {
+				return nil, err
+			}
+			dist = (t&8)<<11 + v>>2
+			trailing = v & 3
+			if dist == 0 {
+				if length != 3 || ip != len(src) || len(dst) != dstLen {
+					return nil, errLZOCorrupt
+				}
+				return dst, nil
+			}
+			dist += 0x4000
+		}
+
+		if err := copyMatch(dist, length); err != nil {
+			return nil, err
+		}
+		if err := copyLiterals(trailing); err != nil {
+			return nil, err
+		}
+		state = trailing
+	}
+}
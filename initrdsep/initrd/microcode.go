@@ -0,0 +1,151 @@
+package initrd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// MicrocodeUpdate describes a CPU microcode update found in an early
+// microcode archive.
+type MicrocodeUpdate struct {
+	Vendor string `json:"vendor"`
+	// Signatures are the CPUID signatures of the processors the update
+	// applies to.
+	Signatures []uint32 `json:"signatures"`
+	// Platforms is the processor flags mask of Intel updates.
+	Platforms uint32 `json:"platforms,omitempty"`
+	Revision  uint32 `json:"revision"`
+	Date      string `json:"date"`
+}
+
+func (u MicrocodeUpdate) String() string {
+	s := fmt.Sprintf("%s microcode revision %#x from %s for", u.Vendor, u.Revision, u.Date)
+	for _, sig := range u.Signatures {
+		s += fmt.Sprintf(" 0x%08x", sig)
+	}
+	if u.Platforms != 0 {
+		s += fmt.Sprintf(" (platforms 0x%02x)", u.Platforms)
+	}
+	return s
+}
+
+// parseIntelMicrocode parses a file of concatenated Intel microcode updates,
+// as found at kernel/x86/microcode/GenuineIntel.bin.
+// https://elixir.bootlin.com/linux/v6.11.2/source/arch/x86/include/asm/microcode.h
+func parseIntelMicrocode(data []byte) ([]MicrocodeUpdate, error) {
+	const (
+		headerSize         = 48
+		defaultDataSize    = 2000
+		extHeaderSize      = 20
+		extSignatureSize   = 12
+		supportedHeaderVer = 1
+	)
+
+	var updates []MicrocodeUpdate
+	for len(data) > 0 {
+		if len(data) < headerSize {
+			return updates, fmt.Errorf("truncated intel microcode header of %d bytes", len(data))
+		}
+		le := binary.LittleEndian
+		if hdrVer := le.Uint32(data); hdrVer != supportedHeaderVer {
+			return updates, fmt.Errorf("unsupported intel microcode header version %d", hdrVer)
+		}
+		u := MicrocodeUpdate{
+			Vendor:     "intel",
+			Revision:   le.Uint32(data[4:]),
+			Date:       microcodeDate(le.Uint32(data[8:])),
+			Signatures: []uint32{le.Uint32(data[12:])},
+			Platforms:  le.Uint32(data[24:]),
+		}
+		// Sizes of zero denote the original fixed size updates.
+		dataSize, totalSize := le.Uint32(data[28:]), le.Uint32(data[32:])
+		if dataSize == 0 {
+			dataSize = defaultDataSize
+		}
+		if totalSize == 0 {
+			totalSize = dataSize + headerSize
+		}
+		if totalSize < dataSize+headerSize || uint64(totalSize) > uint64(len(data)) {
+			return updates, fmt.Errorf("invalid intel microcode size %d", totalSize)
+		}
+
+		// An extended signature table lists further processors.
+		if ext := data[headerSize+dataSize : totalSize]; len(ext) >= extHeaderSize {
+			count := le.Uint32(ext)
+			if uint64(count)*extSignatureSize > uint64(len(ext)-extHeaderSize) {
+				return updates, fmt.Errorf("intel microcode extended signature count %d exceeds update size", count)
+			}
+			for i := range count {
+				sig := ext[extHeaderSize+i*extSignatureSize:]
+				u.Signatures = append(u.Signatures, le.Uint32(sig))
+			}
+		}
+		updates = append(updates, u)
+		data = data[totalSize:]
+	}
+	return updates, nil
+}
+
+// parseAMDMicrocode parses AMD microcode containers, as found at
+// kernel/x86/microcode/AuthenticAMD.bin. A container holds an equivalence
+// table mapping CPUID signatures to equivalence IDs, followed by the patches.
+// https://elixir.bootlin.com/linux/v6.11.2/source/arch/x86/kernel/cpu/microcode/amd.c
+func parseAMDMicrocode(data []byte) ([]MicrocodeUpdate, error) {
+	const (
+		containerMagic     = 0x00414d44
+		sectionHeaderSize  = 8
+		equivTableType     = 0
+		patchType          = 1
+		equivEntrySize     = 16
+		patchHeaderMinSize = 0x20
+	)
+
+	le := binary.LittleEndian
+	var updates []MicrocodeUpdate
+	for len(data) > 0 {
+		if len(data) < 4+sectionHeaderSize || le.Uint32(data) != containerMagic {
+			return updates, errors.New("invalid amd microcode container magic")
+		}
+		data = data[4:]
+		if le.Uint32(data) != equivTableType {
+			return updates, errors.New("amd microcode container doesn't start with equivalence table")
+		}
+		tableSize := le.Uint32(data[4:])
+		if uint64(tableSize) > uint64(len(data)-sectionHeaderSize) {
+			return updates, fmt.Errorf("amd microcode equivalence table size %d exceeds container", tableSize)
+		}
+		table := data[sectionHeaderSize : sectionHeaderSize+tableSize]
+		data = data[sectionHeaderSize+tableSize:]
+
+		// Patches follow until the next container or the end of the file.
+		for len(data) >= sectionHeaderSize && le.Uint32(data) == patchType {
+			size := le.Uint32(data[4:])
+			if uint64(size) > uint64(len(data)-sectionHeaderSize) || size < patchHeaderMinSize {
+				return updates, fmt.Errorf("invalid amd microcode patch size %d", size)
+			}
+			patch := data[sectionHeaderSize : sectionHeaderSize+size]
+			data = data[sectionHeaderSize+size:]
+
+			equivID := le.Uint16(patch[24:])
+			u := MicrocodeUpdate{
+				Vendor:   "amd",
+				Date:     microcodeDate(le.Uint32(patch)),
+				Revision: le.Uint32(patch[4:]),
+			}
+			for e := table; len(e) >= equivEntrySize; e = e[equivEntrySize:] {
+				if le.Uint16(e[12:]) == equivID && le.Uint32(e) != 0 {
+					u.Signatures = append(u.Signatures, le.Uint32(e))
+				}
+			}
+			updates = append(updates, u)
+		}
+	}
+	return updates, nil
+}
+
+// microcodeDate formats a microcode date, which is stored as BCD digits in
+// the order month, day, year.
+func microcodeDate(v uint32) string {
+	return fmt.Sprintf("%04x-%02x-%02x", v&0xffff, v>>24, (v>>16)&0xff)
+}
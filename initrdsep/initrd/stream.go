@@ -0,0 +1,214 @@
+package initrd
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// maxLookbehind is the number of bytes before the current position a
+// lookaheadReader can seek back to. Decompressors seek back to undo their
+// read-ahead and to check stream footers, which both are small. A failed
+// segment is rewound to its start, which is kept as well.
+const maxLookbehind = 1 << 20
+
+var errSeekBehindBuffer = errors.New("seeking back beyond the lookahead buffer")
+
+// lookaheadReader makes a reader seekable within a bounded window, so initrds
+// can be separated from stdin or pipes. It keeps at least the last
+// maxLookbehind bytes before the current position, and the data from the
+// start of the current segment on. If the underlying reader is seekable, like
+// a regular file, it seeks there instead of keeping the segment. Seeking
+// forward reads and discards the skipped data, seeking relative to the end
+// isn't supported.
+//
+// As separated data can't be read again, the reader also hashes the bytes of
+// the current segment and of the whole input while they pass through.
+type lookaheadReader struct {
+	src io.Reader
+	// seeker is src if it's seekable, origin the offset in src the input
+	// starts at.
+	seeker io.Seeker
+	origin int64
+	// buf holds the input from offset base on.
+	buf  []byte
+	base int64
+	pos  int64
+	err  error
+	// start is the offset of the current segment, or -1.
+	start int64
+
+	// input hashes everything read from src, inputSize is the offset of
+	// the next byte to add. Data read again after seeking back isn't added.
+	input     hash.Hash
+	inputSize int64
+	// segment hashes the input from the offset passed to beginSegment on,
+	// hashed is the offset of the next byte to add.
+	segment hash.Hash
+	hashed  int64
+}
+
+func newLookaheadReader(src io.Reader) *lookaheadReader {
+	l := &lookaheadReader{
+		src:     src,
+		start:   -1,
+		input:   sha256.New(),
+		segment: sha256.New(),
+		hashed:  -1,
+	}
+	// Pipes implement io.Seeker, but fail to seek.
+	if seeker, ok := src.(io.Seeker); ok {
+		if origin, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			l.seeker, l.origin = seeker, origin
+		}
+	}
+	return l
+}
+
+func (l *lookaheadReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for l.pos >= l.base+int64(len(l.buf)) {
+		if l.err != nil {
+			return 0, l.err
+		}
+		l.fill()
+	}
+	n := copy(p, l.buf[l.pos-l.base:])
+	l.pos += int64(n)
+	l.trim()
+	return n, nil
+}
+
+func (l *lookaheadReader) Seek(offset int64, whence int) (int64, error) {
+	target := offset
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		target += l.pos
+	default:
+		return l.pos, errors.New("seeking relative to the end of a stream is not supported")
+	}
+	if target < l.base {
+		if l.seeker == nil {
+			return l.pos, errSeekBehindBuffer
+		}
+		if _, err := l.seeker.Seek(l.origin+target, io.SeekStart); err != nil {
+			return l.pos, fmt.Errorf("seeking input: %w", err)
+		}
+		l.buf = l.buf[:0]
+		l.base, l.pos, l.err = target, target, nil
+		return l.pos, nil
+	}
+	// Read up to the target, so the buffer can be trimmed on the way. Like
+	// files, seeking beyond the end is allowed.
+	for target > l.base+int64(len(l.buf)) && l.err == nil {
+		l.pos = l.base + int64(len(l.buf))
+		l.fill()
+		l.trim()
+	}
+	l.pos = target
+	return l.pos, nil
+}
+
+// fill reads the next chunk of the input into the buffer.
+func (l *lookaheadReader) fill() {
+	const chunkSize = 32 << 10
+	start := len(l.buf)
+	l.buf = append(l.buf, make([]byte, chunkSize)...)
+	n, err := l.src.Read(l.buf[start:])
+	l.buf = l.buf[:start+n]
+	if end := l.base + int64(len(l.buf)); end > l.inputSize {
+		l.input.Write(l.buf[l.inputSize-l.base:])
+		l.inputSize = end
+	}
+	if err != nil {
+		l.err = err
+	}
+}
+
+// trim drops data that is too far behind the current position. To not move
+// the buffer on every read, it only does so once that is twice the required
+// amount. Unless src is seekable, the current segment is kept.
+func (l *lookaheadReader) trim() {
+	drop := l.pos - maxLookbehind - l.base
+	if l.seeker == nil && l.start >= 0 {
+		drop = min(drop, l.start-l.base)
+	}
+	if drop < maxLookbehind {
+		return
+	}
+	if l.hashed >= 0 && l.hashed < l.base+drop {
+		l.segment.Write(l.buf[max(l.hashed-l.base, 0):drop])
+		l.hashed = l.base + drop
+	}
+	n := copy(l.buf, l.buf[drop:])
+	l.buf = l.buf[:n]
+	l.base += drop
+}
+
+// beginSegment starts hashing the input at the current position.
+func (l *lookaheadReader) beginSegment() {
+	l.segment.Reset()
+	l.hashed = l.pos
+	l.start = l.pos
+}
+
+// segmentDigest returns the sha256 of the input from the start of the
+// segment up to the current position.
+func (l *lookaheadReader) segmentDigest() ([]byte, error) {
+	if l.hashed < l.base || l.pos > l.base+int64(len(l.buf)) {
+		return nil, fmt.Errorf("segment ending at %d is not buffered", l.pos)
+	}
+	if l.pos > l.hashed {
+		l.segment.Write(l.buf[l.hashed-l.base : l.pos-l.base])
+		l.hashed = l.pos
+	}
+	return l.segment.Sum(nil), nil
+}
+
+// inputDigest returns the size and sha256 of the input read so far. Once the
+// input is consumed, this describes the whole input.
+func (l *lookaheadReader) inputDigest() (int64, []byte) {
+	return l.inputSize, l.input.Sum(nil)
+}
+
+// pipeWriter is a writer that passes the data written to it to a function
+// running in the background.
+type pipeWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+// newPipeWriter returns a pipeWriter passing the written data to process.
+// Close returns the result of process.
+func newPipeWriter(process func(io.Reader) error) *pipeWriter {
+	pr, pw := io.Pipe()
+	p := &pipeWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := process(pr)
+		// Unblock the writer if processing stopped early.
+		pr.CloseWithError(err)
+		p.done <- err
+	}()
+	return p
+}
+
+func (p *pipeWriter) Write(b []byte) (int, error) {
+	return p.pw.Write(b)
+}
+
+func (p *pipeWriter) Close() error {
+	p.pw.Close()
+	return <-p.done
+}
+
+// CloseWithError closes the pipe, letting process fail with err if it reads
+// any further, and returns the result of process.
+func (p *pipeWriter) CloseWithError(err error) error {
+	p.pw.CloseWithError(err)
+	return <-p.done
+}
@@ -0,0 +1,144 @@
+package initrd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// xzDecompressor decompresses a single xz stream.
+// https://tukaani.org/xz/xz-file-format.txt
+func xzDecompressor(in io.ReadSeeker, out io.Writer) error {
+	start, err := in.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("getting current position: %w", err)
+	}
+	// Keep the stream header for the index check, as the start of the
+	// stream may be out of reach by then.
+	header, err := peek(in, xzHeaderSize)
+	if err != nil {
+		return fmt.Errorf("reading xz stream header: %w", err)
+	}
+	var copyErr error
+	if _, err := consumeCounting(in, func(cr *countingReader) error {
+		d, err := xz.ReaderConfig{SingleStream: true}.NewReader(cr)
+		if err != nil {
+			return fmt.Errorf("reading xz stream header: %w", err)
+		}
+		if _, copyErr = io.Copy(out, d); copyErr != nil {
+			// In single stream mode, the reader reads one more byte
+			// to check that no data follows the stream. If the stream
+			// was valid, the index check below will confirm that.
+			cr.unread(1)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := xzCheckIndex(in, header, start); err != nil {
+		if copyErr != nil {
+			return fmt.Errorf("decompressing xz: %w", copyErr)
+		}
+		return fmt.Errorf("checking xz index: %w", err)
+	}
+	fmt.Fprintln(Progress, "successfully decompressed xz")
+	return nil
+}
+
+const (
+	xzHeaderSize = 12
+	xzFooterSize = 12
+)
+
+// xzCheckIndex checks that the xz stream starting at start with the given
+// header ends at the current position of in. It reads the stream footer and
+// walks the index backwards, verifying that the sizes of all blocks recorded
+// in the index add up to the size of the stream.
+func xzCheckIndex(in io.ReadSeeker, header []byte, start int64) error {
+	end, err := in.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("getting current position: %w", err)
+	}
+	streamSize := end - start
+	if streamSize < xzHeaderSize+xzFooterSize {
+		return fmt.Errorf("stream of %d bytes is too short", streamSize)
+	}
+
+	footer, err := peekAt(in, -xzFooterSize, xzFooterSize)
+	if err != nil {
+		return fmt.Errorf("reading stream footer: %w", err)
+	}
+	if !bytes.Equal(footer[10:], []byte("YZ")) {
+		return fmt.Errorf("invalid stream footer magic %x", footer[10:])
+	}
+	if crc32.ChecksumIEEE(footer[4:10]) != binary.LittleEndian.Uint32(footer[:4]) {
+		return errors.New("stream footer checksum mismatch")
+	}
+	if !bytes.Equal(header[6:8], footer[8:10]) {
+		return fmt.Errorf("stream flags in header %x and footer %x differ", header[6:8], footer[8:10])
+	}
+
+	indexSize := (int64(binary.LittleEndian.Uint32(footer[4:8])) + 1) * 4
+	if indexSize > streamSize-xzHeaderSize-xzFooterSize {
+		return fmt.Errorf("index size %d exceeds stream size %d", indexSize, streamSize)
+	}
+	index, err := peekAt(in, -int(xzFooterSize+indexSize), int(indexSize))
+	if err != nil {
+		return fmt.Errorf("reading index: %w", err)
+	}
+	if crc32.ChecksumIEEE(index[:indexSize-4]) != binary.LittleEndian.Uint32(index[indexSize-4:]) {
+		return errors.New("index checksum mismatch")
+	}
+	if index[0] != 0 {
+		return fmt.Errorf("invalid index indicator %#x", index[0])
+	}
+
+	r := bytes.NewReader(index[1 : indexSize-4])
+	records, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fmt.Errorf("reading number of index records: %w", err)
+	}
+	var blocksSize int64
+	for i := uint64(0); i < records; i++ {
+		unpaddedSize, err := binary.ReadUvarint(r)
+		if err != nil {
+			return fmt.Errorf("reading unpadded size of record %d: %w", i, err)
+		}
+		if _, err := binary.ReadUvarint(r); err != nil {
+			return fmt.Errorf("reading uncompressed size of record %d: %w", i, err)
+		}
+		blocksSize += int64(unpaddedSize+3) &^ 3
+	}
+
+	if want := xzHeaderSize + blocksSize + indexSize + xzFooterSize; want != streamSize {
+		return fmt.Errorf("index describes a stream of %d bytes, but stream has %d bytes", want, streamSize)
+	}
+	return nil
+}
+
+// lzmaDecompressor decompresses a stream in the legacy .lzma format. The
+// header may or may not contain the uncompressed size, and the stream may or
+// may not end with an end marker, but the range decoder stops exactly at the
+// end of the compressed data either way.
+func lzmaDecompressor(in io.ReadSeeker, out io.Writer) error {
+	if _, err := consumeCounting(in, func(cr *countingReader) error {
+		d, err := lzma.NewReader(cr)
+		if err != nil {
+			return fmt.Errorf("reading lzma header: %w", err)
+		}
+		if _, err := io.Copy(out, d); err != nil {
+			return fmt.Errorf("decompressing lzma: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	fmt.Fprintln(Progress, "successfully decompressed lzma")
+	return nil
+}
@@ -0,0 +1,175 @@
+package initrd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// isZstdSkippable reports whether magic starts a skippable frame, which has
+// a magic of 0x184D2A5?.
+func isZstdSkippable(magic []byte) bool {
+	return len(magic) >= 4 && magic[0]&0xf0 == 0x50 && bytes.Equal(magic[1:4], []byte{0x2a, 0x4d, 0x18})
+}
+
+// zstdDecompressor decompresses a zstd stream, which may consist of multiple
+// frames, for example when written by a parallel compressor, and contain
+// skippable frames. Like the kernel, frames are decompressed as long as they
+// follow each other. As a zstd initrd may also directly follow another, a new
+// initrd is started when the previous frames end with a complete cpio archive.
+// The content checksum of frames is verified by the decoder. The frames are
+// counted in seg.
+// https://github.com/facebook/zstd/blob/dev/doc/zstd_compression_format.md
+func zstdDecompressor(seg *Segment) decompressor {
+	return func(in io.ReadSeeker, out io.Writer) error {
+		var frames, skippable, checksums int
+		boundary := &cpioBoundary{}
+		for {
+			magic, err := peek(in, 4)
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			} else if err != nil {
+				return fmt.Errorf("reading zstd frame magic: %w", err)
+			}
+
+			if isZstdSkippable(magic) {
+				if err := skipZstdSkippableFrame(in); err != nil {
+					return err
+				}
+				skippable++
+				continue
+			}
+			if !bytes.Equal(magic, zstdMagic) || (frames > 0 && boundary.atArchiveEnd()) {
+				break
+			}
+
+			hasChecksum, err := decompressZstdFrame(in, io.MultiWriter(out, boundary))
+			if err != nil {
+				return fmt.Errorf("frame %d: %w", frames, err)
+			}
+			frames++
+			if hasChecksum {
+				checksums++
+			}
+		}
+		if frames == 0 {
+			return errors.New("no zstd frame found")
+		}
+		seg.Frames, seg.SkippableFrames = frames, skippable
+		fmt.Fprintf(Progress, "successfully decompressed zstd: %d frames, %d skippable frames, %d content checksums verified\n",
+			frames, skippable, checksums)
+		return nil
+	}
+}
+
+// decompressZstdFrame decompresses the zstd frame at the current position of
+// in. The frame is passed to the decoder block by block, so the decoder
+// doesn't read beyond its end. It reports whether the frame has a content
+// checksum.
+func decompressZstdFrame(in io.ReadSeeker, out io.Writer) (bool, error) {
+	decoder := newPipeWriter(func(r io.Reader) error {
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		defer d.Close()
+		_, err = io.Copy(out, d)
+		return err
+	})
+	hasChecksum, err := copyZstdFrame(decoder, in)
+	if err != nil {
+		decoder.CloseWithError(err)
+		return false, fmt.Errorf("reading zstd frame: %w", err)
+	}
+	if err := decoder.Close(); err != nil {
+		return false, fmt.Errorf("decompressing zstd: %w", err)
+	}
+	return hasChecksum, nil
+}
+
+// copyZstdFrame copies the zstd frame at the current position of in to out.
+// Its end is found by walking the block headers. It reports whether the
+// frame has a content checksum.
+func copyZstdFrame(out io.Writer, in io.ReadSeeker) (bool, error) {
+	const zsdtBlockHeaderSize = 3
+
+	var header zstd.Header
+	// The header has up to 18 bytes, small frames may end before.
+	buf, err := peekAvailable(in, 18)
+	if err != nil {
+		return false, fmt.Errorf("reading zstd header: %w", err)
+	}
+	if err := header.Decode(buf); err != nil {
+		return false, fmt.Errorf("decoding zstd header: %w", err)
+	}
+	if _, err := io.CopyN(out, in, int64(header.HeaderSize)); err != nil {
+		return false, fmt.Errorf("copying zstd header: %w", err)
+	}
+
+	bhBytes := make([]byte, zsdtBlockHeaderSize)
+	for {
+		if _, err := io.ReadFull(in, bhBytes); err != nil {
+			return false, fmt.Errorf("reading zstd block header: %w", err)
+		}
+		if _, err := out.Write(bhBytes); err != nil {
+			return false, err
+		}
+		// https://github.com/klauspost/compress/blob/2a46d6bf5d0fb5d9f44b815438ce43470706f73f/zstd/blockdec.go#L139
+		blockHeader := uint32(bhBytes[0]) | (uint32(bhBytes[1]) << 8) | (uint32(bhBytes[2]) << 16)
+		blockType := zstdBlockType((blockHeader >> 1) & 3)
+		blockIsLast := blockHeader&1 != 0
+		var blockSize int64
+		switch blockType {
+		case zsdtBlockTypeRLE:
+			blockSize = 1
+		case zsdtBlockTypeCompressed:
+			fallthrough
+		case zsdtBlockTypeRaw:
+			blockSize = int64(blockHeader >> 3)
+		default:
+			return false, fmt.Errorf("invalid zstd block type %d", blockType)
+		}
+		if _, err := io.CopyN(out, in, blockSize); err != nil {
+			return false, fmt.Errorf("copying zstd block: %w", err)
+		}
+		if blockIsLast {
+			break
+		}
+	}
+
+	if header.HasCheckSum {
+		if _, err := io.CopyN(out, in, 4); err != nil {
+			return false, fmt.Errorf("copying zstd checksum: %w", err)
+		}
+	}
+	return header.HasCheckSum, nil
+}
+
+// skipZstdSkippableFrame skips the skippable frame at the current position
+// of in, consisting of the magic, the size of the frame data and the data.
+func skipZstdSkippableFrame(in io.ReadSeeker) error {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return fmt.Errorf("reading zstd skippable frame header: %w", err)
+	}
+	size := int64(binary.LittleEndian.Uint32(header[4:]))
+	if n, err := io.CopyN(io.Discard, in, size); err != nil {
+		return fmt.Errorf("skipping zstd skippable frame: %d of %d bytes: %w", n, size, err)
+	}
+	return nil
+}
+
+type zstdBlockType uint8
+
+const (
+	zsdtBlockTypeRaw zstdBlockType = iota
+	zsdtBlockTypeRLE
+	zsdtBlockTypeCompressed
+	zsdtBlockTypeReserved
+)
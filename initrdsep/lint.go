@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/katexochen/image-tools/initrdsep/initrd"
+)
+
+// lintFinding is a property of a cpio entry that prevents the initrd from
+// being bit-for-bit reproducible.
+type lintFinding struct {
+	Initrd int    `json:"initrd"`
+	Offset int64  `json:"offset"`
+	Name   string `json:"name"`
+	Check  string `json:"check"`
+	Detail string `json:"detail"`
+}
+
+// lint checks the cpio archives in the initrds in the file at args[0] for
+// properties that differ between builds. Each finding is printed as a JSON
+// object on its own line. An error is returned if there are findings.
+//
+// Modification times must be zero or match SOURCE_DATE_EPOCH, if set.
+func lint(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s lint <path>", os.Args[0])
+	}
+	setProgress(os.Stderr)
+
+	var epoch *int64
+	if s, ok := os.LookupEnv("SOURCE_DATE_EPOCH"); ok {
+		e, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("parsing SOURCE_DATE_EPOCH: %w", err)
+		}
+		epoch = &e
+	}
+
+	f, err := openInput(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(os.Stdout)
+	var findings int
+	for seg, err := range initrd.NewReader(f).Segments() {
+		if err != nil {
+			return err
+		}
+		l := &linter{initrd: seg.Index, epoch: epoch, inodes: make(map[uint64]bool)}
+		if err := initrd.WalkCPIO(seg.Content, l.check); err != nil {
+			return err
+		}
+		for _, f := range l.findings {
+			if err := enc.Encode(f); err != nil {
+				return err
+			}
+		}
+		findings += len(l.findings)
+	}
+	if findings > 0 {
+		return fmt.Errorf("found %d reproducibility issues", findings)
+	}
+	return nil
+}
+
+// linter checks the entries of the cpio archives of a single initrd.
+type linter struct {
+	initrd int
+	epoch  *int64
+	// inodes are the inode numbers seen so far, lastIno is the last one.
+	inodes   map[uint64]bool
+	lastIno  uint64
+	lastName string
+	findings []lintFinding
+}
+
+func (l *linter) check(hdr *initrd.CPIOHeader, _ io.Reader) error {
+	report := func(check, format string, a ...any) {
+		l.findings = append(l.findings, lintFinding{
+			Initrd: l.initrd,
+			Offset: hdr.Offset,
+			Name:   hdr.Name,
+			Check:  check,
+			Detail: fmt.Sprintf(format, a...),
+		})
+	}
+
+	if hdr.Mtime != 0 && (l.epoch == nil || hdr.Mtime != *l.epoch) {
+		if l.epoch != nil {
+			report("mtime", "mtime %d is neither 0 nor SOURCE_DATE_EPOCH %d", hdr.Mtime, *l.epoch)
+		} else {
+			report("mtime", "mtime %d is not 0", hdr.Mtime)
+		}
+	}
+
+	// Reproducible archivers number inodes consecutively in the order of the
+	// entries. Hard links reuse the inode number of an earlier entry.
+	if !(hdr.Nlink > 1 && l.inodes[hdr.Ino]) {
+		if len(l.inodes) > 0 && hdr.Ino != l.lastIno+1 {
+			report("ino", "inode %d does not follow inode %d", hdr.Ino, l.lastIno)
+		}
+		l.inodes[hdr.Ino] = true
+		l.lastIno = hdr.Ino
+	}
+
+	if hdr.UID != 0 || hdr.GID != 0 {
+		report("owner", "owner %d:%d is not root", hdr.UID, hdr.GID)
+	}
+
+	if l.lastName != "" && hdr.Name < l.lastName {
+		report("order", "entry is sorted before previous entry %q", l.lastName)
+	}
+	l.lastName = hdr.Name
+
+	if hdr.FileType() == initrd.CPIOModeRegular && (hdr.DevMajor != 0 || hdr.DevMinor != 0) {
+		report("dev", "regular file has device number %d:%d", hdr.DevMajor, hdr.DevMinor)
+	}
+
+	if hdr.Format == initrd.CPIOFormatNewc && hdr.Check != 0 {
+		report("check", "c_check is %#x in newc archive", hdr.Check)
+	}
+	return nil
+}
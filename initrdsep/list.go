@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/katexochen/image-tools/initrdsep/initrd"
+)
+
+// list prints the header fields of all cpio entries in the initrds in the file
+// at args[0], together with the offset of each entry in the decompressed
+// stream and the sha256 of its data.
+func list(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s list <path>", os.Args[0])
+	}
+	// Keep stdout free for the listing.
+	setProgress(os.Stderr)
+
+	f, err := openInput(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	defer w.Flush()
+
+	for seg, err := range initrd.NewReader(f).Segments() {
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "initrd_%d:\n", seg.Index)
+		fmt.Fprintln(w, "OFFSET\tFORMAT\tINO\tMODE\tPERMS\tNLINK\tUID\tGID\tSIZE\tMTIME\tDATE\tDEV\tRDEV\tNAMESIZE\tCHECK\tSHA256\tNAME")
+		if err := initrd.WalkCPIO(seg.Content, func(hdr *initrd.CPIOHeader, data io.Reader) error {
+			return listEntry(w, hdr, data)
+		}); err != nil {
+			return err
+		}
+		// The frames are counted once the content is read to its end.
+		if _, err := io.Copy(io.Discard, seg.Content); err != nil {
+			return err
+		}
+		if seg.Compression == "zstd" {
+			fmt.Fprintf(w, "zstd frames: %d, skippable frames: %d\n", seg.Frames, seg.SkippableFrames)
+		}
+	}
+	return nil
+}
+
+func listEntry(w io.Writer, hdr *initrd.CPIOHeader, data io.Reader) error {
+	h := sha256.New()
+	var target []byte
+	var content io.Writer = h
+	if hdr.FileType() == initrd.CPIOModeSymlink {
+		content = &appendWriter{&target, h}
+	}
+	if _, err := io.Copy(content, data); err != nil {
+		return fmt.Errorf("reading data of %s: %w", hdr.Name, err)
+	}
+	digest := "-"
+	if hdr.FileSize > 0 {
+		digest = hex.EncodeToString(h.Sum(nil))
+	}
+	name := hdr.Name
+	if target != nil {
+		name += " -> " + string(target)
+	}
+
+	fmt.Fprintf(w, "%d\t%s\t%d\t%06o\t%s\t%d\t%d\t%d\t%d\t%d\t%s\t%d:%d\t%d:%d\t%d\t%08x\t%s\t%s\n",
+		hdr.Offset, hdr.Format, hdr.Ino, hdr.Mode, modeString(hdr.Mode), hdr.Nlink,
+		hdr.UID, hdr.GID, hdr.FileSize, hdr.Mtime,
+		time.Unix(hdr.Mtime, 0).UTC().Format(time.RFC3339),
+		hdr.DevMajor, hdr.DevMinor, hdr.RDevMajor, hdr.RDevMinor,
+		hdr.NameSize, hdr.Check, digest, name)
+	return nil
+}
+
+// appendWriter appends everything written to it to buf, in addition to
+// writing it to w.
+type appendWriter struct {
+	buf *[]byte
+	w   io.Writer
+}
+
+func (a *appendWriter) Write(p []byte) (int, error) {
+	*a.buf = append(*a.buf, p...)
+	return a.w.Write(p)
+}
+
+// modeString formats a cpio mode like ls -l does.
+func modeString(mode uint32) string {
+	var typ byte
+	switch mode & initrd.CPIOModeType {
+	case initrd.CPIOModeSocket:
+		typ = 's'
+	case initrd.CPIOModeSymlink:
+		typ = 'l'
+	case initrd.CPIOModeRegular:
+		typ = '-'
+	case initrd.CPIOModeBlock:
+		typ = 'b'
+	case initrd.CPIOModeDir:
+		typ = 'd'
+	case initrd.CPIOModeChar:
+		typ = 'c'
+	case initrd.CPIOModeFIFO:
+		typ = 'p'
+	default:
+		typ = '?'
+	}
+	s := []byte{typ, 'r', 'w', 'x', 'r', 'w', 'x', 'r', 'w', 'x'}
+	for i := 0; i < 9; i++ {
+		if mode&(1<<(8-i)) == 0 {
+			s[i+1] = '-'
+		}
+	}
+	// setuid, setgid and sticky replace the execute bit of their class.
+	for i, special := range []struct {
+		bit  uint32
+		char byte
+	}{{0o4000, 's'}, {0o2000, 's'}, {0o1000, 't'}} {
+		if mode&special.bit == 0 {
+			continue
+		}
+		pos := 3 + i*3
+		if s[pos] == 'x' {
+			s[pos] = special.char
+		} else {
+			s[pos] = special.char - 'a' + 'A'
+		}
+	}
+	return string(s)
+}
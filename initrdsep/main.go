@@ -1,322 +1,232 @@
 package main
 
 import (
-	"bytes"
-	"encoding/hex"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
-	"strconv"
+	"path/filepath"
 
-	"github.com/klauspost/compress/zstd"
+	"github.com/katexochen/image-tools/initrdsep/initrd"
 )
 
 func main() {
 	if err := run(); err != nil {
-		fmt.Printf("Error: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 }
 
-func run() error {
-	if len(os.Args) != 2 {
-		return fmt.Errorf("usage: %s <path>", os.Args[0])
-	}
-	path := os.Args[1]
+// progress receives status messages. Commands whose output is meant to be
+// processed further send them to stderr instead.
+var progress io.Writer = os.Stdout
 
-	f, err := os.OpenFile(path, os.O_RDONLY, 0)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
+// setProgress sends the status messages of the command and of separating the
+// initrds to w.
+func setProgress(w io.Writer) {
+	progress = w
+	initrd.Progress = w
+}
 
-	var initrdIndex int
-	for {
-		if err := decompressInitrd(initrdIndex, f); errors.Is(err, io.EOF) {
-			break
-		} else if err != nil {
-			fr, err2 := os.OpenFile("remaining", os.O_CREATE|os.O_WRONLY, 0o644)
-			if err2 != nil {
-				fmt.Printf("creating file for remaining data: %v", err2)
-				return err
-			}
-			defer fr.Close()
-			if _, err := io.Copy(fr, f); err != nil {
-				fmt.Printf("copying remaining data: %v", err)
-			}
-			return err
-		}
-		if _, err := skipPadding(f); errors.Is(err, io.EOF) {
-			break
-		} else if err != nil {
-			return fmt.Errorf("skipping padding: %w", err)
+func run() error {
+	setProgress(os.Stdout)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "list":
+			return list(os.Args[2:])
+		case "lint":
+			return lint(os.Args[2:])
+		case "diff":
+			return diff(os.Args[2:])
+		case "modules":
+			return modules(os.Args[2:])
+		case "normalize":
+			return normalize(os.Args[2:])
+		case "verify":
+			return verify(os.Args[2:])
+		case "dups":
+			return dups(os.Args[2:])
+		case "repack":
+			return repack(os.Args[2:])
 		}
-		initrdIndex++
 	}
-
-	return nil
+	return separate(os.Args[1:])
 }
 
-func decompressInitrd(index int, f *os.File) error {
-	magic, err := peek(f, 2)
-	if err != nil {
+func separate(args []string) error {
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	var opts separateOptions
+	flags.BoolVar(&opts.Extract, "extract", false, "extract each cpio archive into a directory instead of writing it to a file")
+	flags.StringVar(&opts.OutDir, "out-dir", ".", "directory to write the separated initrds to")
+	flags.BoolVar(&opts.Force, "force", false, "overwrite existing outputs")
+	flags.BoolVar(&opts.Descriptive, "descriptive-names", false, "name outputs NN-kind[-compression].cpio instead of initrd_N")
+	manifest := flags.String("manifest", "", "write a JSON manifest describing the separated initrds to this file")
+	if err := flags.Parse(args); err != nil {
 		return err
 	}
-	decompressor, err := compressFormat(magic)
-	if err != nil {
-		return err
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: %s [-extract] [-out-dir <dir>] [-force] [-descriptive-names] [-manifest <file>] <path|-> | list <path|-> | lint <path|-> | diff <path> <path> | verify <path|-> | dups <path|-> | modules [-json] <path|-> | normalize [-epoch <seconds>] [-compression zstd|gzip|none] <path|-> <out> | repack <manifest> <out>", os.Args[0])
 	}
-	out, err := os.OpenFile(fmt.Sprintf("initrd_%d", index), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
+	path := flags.Arg(0)
+
+	f, err := openInput(path)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
-	return decompressor(f, out)
-}
-
-// compressFormat recognizes the compression format based on the magic bytes.
-// Based on https://elixir.bootlin.com/linux/v6.11.2/source/lib/decompress.c#L51-L61
-func compressFormat(magic []byte) (decompressor, error) {
-	if len(magic) < 2 {
-		return nil, fmt.Errorf("minimum magic length is 2")
-	}
-	switch hex.EncodeToString(magic) {
-	case "1f8b":
-		return nil, errors.New("gzip not implemented")
-	case "1f9e":
-		return nil, errors.New("gzip not implemented")
-	case "425a":
-		return nil, errors.New("bzip2 not implemented")
-	case "5d00":
-		return nil, errors.New("lzma not implemented")
-	case "fd37":
-		return nil, errors.New("xz not implemented")
-	case "894c":
-		return nil, errors.New("lzo not implemented")
-	case "0221":
-		return nil, errors.New("lz4 not implemented")
-	case "28b5":
-		// https://github.com/facebook/zstd/blob/dev/doc/zstd_compression_format.md
-		fmt.Println("detected zstd compressed initrd")
-		return func(in io.ReadSeeker, out io.Writer) error {
-			frameSize, err := zstdFrameSize(in)
-			if err != nil {
-				return fmt.Errorf("getting zstd frame size: %w", err)
-			}
-			limitIn := io.LimitReader(in, int64(frameSize))
-			d, err := zstd.NewReader(limitIn)
-			if err != nil {
-				return err
-			}
-			defer d.Close()
-			if _, err := io.Copy(out, d); err != nil {
-				return fmt.Errorf("decompressing zstd: %w", err)
-			}
-			fmt.Println("successfully decompressed zstd")
-			return nil
-		}, nil
-	case "3037":
-		// https://github.com/libyal/dtformats/blob/main/documentation/Copy%20in%20and%20out%20(CPIO)%20archive%20format.asciidoc
-		fmt.Println("detected uncompressed initrd in ascii cpio format")
-		return func(in io.ReadSeeker, out io.Writer) error {
-			size, err := cpioSize(in)
-			if err != nil {
-				return fmt.Errorf("getting cpio ascii size: %w", err)
-			}
-			limitIn := io.LimitReader(in, int64(size))
-			if _, err := io.Copy(out, limitIn); err != nil {
-				return fmt.Errorf("copying cpio ascii: %w", err)
-			}
-			fmt.Println("successfully copied uncompressed cpio archive")
-			return nil
-		}, nil
-	default:
-		return nil, fmt.Errorf("unknown magic bytes %s", hex.EncodeToString(magic))
-	}
-}
-
-type decompressor = func(io.ReadSeeker, io.Writer) error
-
-func cpioSize(in io.ReadSeeker) (int, error) {
-	const cpioHeaderSize = 110
-	const cpioTrailer = "TRAILER!!!\x00"
+	defer f.Close()
+	in := initrd.NewReader(f)
 
-	pos, err := in.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return 0, fmt.Errorf("getting current position: %w", err)
+	segments, remaining, err := separateInitrds(in, opts)
+	if remaining != "" {
+		fmt.Fprintf(progress, "wrote remaining data to %s\n", remaining)
 	}
-	defer in.Seek(pos, io.SeekStart)
-
-	var size int
-	for {
-		magic, err := peek(in, 6)
-		if err != nil {
-			return 0, fmt.Errorf("reading cpio magic: %w", err)
-		}
-
-		switch {
-		case string(magic) == "070701" || string(magic) == "070702":
-			fileSize, err := peekHexIntAt(in, 54, 8)
-			if err != nil {
-				return 0, fmt.Errorf("getting cpio entry file size: %w", err)
-			}
-			pathSize, err := peekHexIntAt(in, 94, 8)
-			if err != nil {
-				return 0, fmt.Errorf("getting cpio entry path size: %w", err)
-			}
-
-			entrySize := cpioHeaderSize
-			entrySize += pathSize
-			entrySize += ((4 - (entrySize % 4)) % 4) // Path padding
-			entrySize += fileSize
-			entrySize += ((4 - (entrySize % 4)) % 4) // File padding
-			size += entrySize
-
-			if pathSize == len(cpioTrailer) {
-				path, err := peekAt(in, cpioHeaderSize, pathSize)
-				if err != nil {
-					return 0, fmt.Errorf("reading cpio path: %w", err)
-				}
-				if string(path) == cpioTrailer {
-					if _, err := in.Seek(int64(entrySize), io.SeekCurrent); err != nil {
-						return 0, fmt.Errorf("seeking next cpio entry: %w", err)
-					}
-					return size, nil
-				}
-			}
-			if _, err := in.Seek(int64(entrySize), io.SeekCurrent); err != nil {
-				return 0, fmt.Errorf("seeking next cpio entry: %w", err)
-			}
-
-		case string(magic) == "070707":
-			panic("portable ascii cpio not implemented")
-		case bytes.Equal(magic[:2], []byte{0x71, 0xC7}):
-			panic("binary cpio format not implemented")
-		default:
-			return 0, fmt.Errorf("unknown cpio magic %s", hex.EncodeToString(magic))
+	// The input has been consumed completely at this point.
+	if *manifest != "" {
+		if err := writeManifest(*manifest, path, in, segments); err != nil {
+			return fmt.Errorf("writing manifest: %w", err)
 		}
 	}
+	return err
 }
 
-func zstdFrameSize(in io.ReadSeeker) (int, error) {
-	const zsdtBlockHeaderSize = 3
-
-	pos, err := in.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return 0, fmt.Errorf("getting current position: %w", err)
-	}
-	defer in.Seek(pos, io.SeekStart)
+type separateOptions struct {
+	// OutDir is the directory the outputs are created in.
+	OutDir string
+	// Extract extracts the cpio archives into directories.
+	Extract bool
+	// Force replaces existing outputs.
+	Force bool
+	// Descriptive names the outputs after their index, kind and
+	// compression, like 00-early-microcode.cpio or 01-main-zstd.cpio,
+	// instead of initrd_N.
+	Descriptive bool
+}
 
-	var header zstd.Header
-	buf, err := peek(in, 18)
-	if err != nil {
-		return 0, fmt.Errorf("reading zstd header: %w", err)
-	}
-	if err := header.Decode(buf); err != nil {
-		return 0, fmt.Errorf("decoding zstd header: %w", err)
-	}
-	size := header.HeaderSize
-	in.Seek(int64(header.HeaderSize), io.SeekCurrent)
-	if header.HasCheckSum {
-		size += 4
+// separateInitrds writes the initrds in in to separate files, or extracts them.
+// The returned segments describe the initrds written successfully, their
+// Output is the path of the created file or directory. If separation fails,
+// the rest of the input is written to a file, whose path is returned as well.
+func separateInitrds(in *initrd.Reader, opts separateOptions) ([]initrdSegment, string, error) {
+	if err := os.MkdirAll(opts.OutDir, 0o755); err != nil {
+		return nil, "", fmt.Errorf("creating output directory: %w", err)
 	}
 
-	for {
-		bhBytes, err := peek(in, zsdtBlockHeaderSize)
-		if err != nil {
-			return 0, fmt.Errorf("reading zstd block header: %w", err)
+	// Descriptive names depend on the content, so outputs are renamed once
+	// it's known.
+	tmpName := func(index int) string {
+		if opts.Descriptive {
+			return fmt.Sprintf(".initrd_%d.partial", index)
 		}
-		// https://github.com/klauspost/compress/blob/2a46d6bf5d0fb5d9f44b815438ce43470706f73f/zstd/blockdec.go#L139
-		blockHeader := uint32(bhBytes[0]) | (uint32(bhBytes[1]) << 8) | (uint32(bhBytes[2]) << 16)
-		blockType := zstdBlockType((blockHeader >> 1) & 3)
-		blockIsLast := blockHeader&1 != 0
-		blockSize := zsdtBlockHeaderSize
-		switch blockType {
-		case zsdtBlockTypeRLE:
-			blockSize += 1
-		case zsdtBlockTypeCompressed:
-			fallthrough
-		case zsdtBlockTypeRaw:
-			blockSize += int(blockHeader >> 3)
-		default:
-			panic("Invalid block type")
+		return fmt.Sprintf("initrd_%d", index)
+	}
+	var segments []initrdSegment
+	var err error
+	for seg, iterErr := range in.Segments() {
+		if err = iterErr; err != nil {
+			break
 		}
-		size += blockSize
-		in.Seek(int64(blockSize), io.SeekCurrent)
-		if blockIsLast {
+		path := filepath.Join(opts.OutDir, tmpName(seg.Index))
+		if err = writeSegment(seg, path, opts); err != nil {
 			break
 		}
+		segments = append(segments, initrdSegment{Segment: *seg})
 	}
 
-	return size, nil
-}
-
-type zstdBlockType uint8
-
-const (
-	zsdtBlockTypeRaw zstdBlockType = iota
-	zsdtBlockTypeRLE
-	zsdtBlockTypeCompressed
-	zsdtBlockTypeReserved
-)
-
-func skipPadding(in io.ReadSeeker) (int, error) {
-	var skipped int
-	for {
-		b, err := peek(in, 1)
-		if err != nil {
-			return 0, fmt.Errorf("reading single padding byte: %w", err)
+	var renameErr error
+	for i := range segments {
+		seg := &segments[i]
+		seg.Output = filepath.Join(opts.OutDir, tmpName(seg.Index))
+		if !opts.Descriptive || renameErr != nil {
+			continue
 		}
-		if b[0] != 0 {
-			return skipped, nil
+		name := fmt.Sprintf("%02d-%s", seg.Index, seg.Kind)
+		if seg.Compression != "none" {
+			name += "-" + seg.Compression
 		}
-		if _, err = in.Seek(1, io.SeekCurrent); err != nil {
-			return 0, fmt.Errorf("skipping padding: %w", err)
+		if !opts.Extract {
+			name += ".cpio"
 		}
-		skipped++
+		path := filepath.Join(opts.OutDir, name)
+		if renameErr = prepareOutput(path, opts.Force); renameErr != nil {
+			break
+		}
+		if renameErr = os.Rename(seg.Output, path); renameErr != nil {
+			break
+		}
+		seg.Output = path
+	}
+	if err == nil {
+		return segments, "", renameErr
 	}
-}
 
-func peek(f io.ReadSeeker, n int) ([]byte, error) {
-	b := make([]byte, n)
-	if _, err := f.Read(b); err != nil {
-		return nil, err
+	remaining := filepath.Join(opts.OutDir, "remaining")
+	fr, err2 := createOutput(remaining, opts.Force)
+	if err2 != nil {
+		return segments, "", errors.Join(err, fmt.Errorf("creating file for remaining data: %w", err2))
 	}
-	if _, err := f.Seek(-int64(n), io.SeekCurrent); err != nil {
-		return nil, err
+	defer fr.Close()
+	if _, err2 := io.Copy(fr, in.Remaining()); err2 != nil {
+		return segments, remaining, errors.Join(err, fmt.Errorf("copying remaining data: %w", err2))
 	}
-	return b, nil
+	return segments, remaining, errors.Join(err, renameErr, fr.Close())
 }
 
-func peekAt(f io.ReadSeeker, offset, n int) ([]byte, error) {
-	pos, err := f.Seek(0, io.SeekCurrent)
+// writeSegment writes the content of seg to a file at path, or extracts it
+// into a directory at path.
+func writeSegment(seg *initrd.Segment, path string, opts separateOptions) error {
+	if opts.Extract {
+		if err := prepareOutput(path, opts.Force || opts.Descriptive); err != nil {
+			return err
+		}
+		return extractCPIO(seg.Content, path)
+	}
+	out, err := createOutput(path, opts.Force || opts.Descriptive)
 	if err != nil {
-		return nil, fmt.Errorf("getting current position: %w", err)
+		return err
 	}
-	defer f.Seek(pos, io.SeekStart)
-	if _, err := f.Seek(int64(offset), io.SeekCurrent); err != nil {
-		return nil, fmt.Errorf("seeking to offset %d: %w", offset, err)
+	defer out.Close()
+	if _, err := io.Copy(out, seg.Content); err != nil {
+		return err
 	}
-	return peek(f, n)
+	return out.Close()
 }
 
-func peekHexIntAt(f io.ReadSeeker, offset, size int) (int, error) {
-	pos, err := f.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return 0, fmt.Errorf("getting current position: %w", err)
+// createOutput creates the file at path. Unless force is set, the file must
+// not exist yet.
+func createOutput(path string, force bool) (*os.File, error) {
+	if err := prepareOutput(path, force); err != nil {
+		return nil, err
 	}
-	defer f.Seek(pos, io.SeekStart)
-	if _, err := f.Seek(int64(offset), io.SeekCurrent); err != nil {
-		return 0, fmt.Errorf("seeking to offset %d: %w", offset, err)
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
+}
+
+// prepareOutput makes sure that nothing exists at path, removing what is
+// there if force is set.
+func prepareOutput(path string, force bool) error {
+	if _, err := os.Lstat(path); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
 	}
-	buf := make([]byte, size)
-	if _, err := f.Read(buf); err != nil {
-		return 0, fmt.Errorf("reading %d bytes at offset %d: %w", size, offset, err)
+	if !force {
+		return fmt.Errorf("%s already exists", path)
 	}
-	i, err := strconv.ParseInt(string(buf), 16, 64)
-	if err != nil {
-		return 0, fmt.Errorf("parsing hex int %s: %w", string(buf), err)
+	return os.RemoveAll(path)
+}
+
+// initrdSegment is an initrd that was separated.
+type initrdSegment struct {
+	initrd.Segment
+	// Output is the path of the file or directory the initrd was written to.
+	Output string `json:"output,omitempty"`
+}
+
+// openInput opens the file at path, or stdin for "-".
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
 	}
-	return int(i), nil
+	return os.Open(path)
 }
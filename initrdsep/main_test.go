@@ -1,12 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"debug/elf"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"math/big"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
 
+	"github.com/katexochen/image-tools/initrdsep/initrd"
 	it "github.com/katexochen/image-tools/internal/testing"
+	"github.com/ulikunitz/xz"
 )
 
 func TestInitrdsep(t *testing.T) {
@@ -32,12 +48,8 @@ func TestInitrdsep(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-			os.Args[1] = inPath
 			tmpDir := t.TempDir()
-
-			if err := os.Chdir(tmpDir); err != nil {
-				t.Fatal(err)
-			}
+			os.Args = []string{os.Args[0], "-out-dir", tmpDir, inPath}
 
 			if err := run(); err != nil {
 				t.Fatal(fmt.Errorf("running initrdsep: %w", err))
@@ -54,3 +66,618 @@ func TestInitrdsep(t *testing.T) {
 		})
 	}
 }
+
+func TestExtractCPIO(t *testing.T) {
+	testCases := map[string]struct {
+		entries   []it.CPIOEntry
+		wantFiles map[string]string
+		wantLinks map[string]string
+		wantErr   bool
+	}{
+		"tree": {
+			entries: []it.CPIOEntry{
+				{Name: ".", Mode: 0o40755},
+				{Name: "etc", Mode: 0o40750},
+				{Name: "etc/hostname", Mode: 0o100644, Data: []byte("initrd\n")},
+				{Name: "bin", Mode: 0o120777, Data: []byte("usr/bin")},
+				{Name: "/usr/bin/true", Mode: 0o100755, Data: []byte("binary")},
+				{Name: "usr/bin/a", Mode: 0o100755, Ino: 100, Nlink: 2},
+				{Name: "usr/bin/b", Mode: 0o100755, Data: []byte("linked"), Ino: 100, Nlink: 2},
+				{Name: "dev/console", Mode: 0o20600},
+			},
+			wantFiles: map[string]string{
+				"etc/hostname": "initrd\n",
+				"usr/bin/true": "binary",
+				"usr/bin/a":    "linked",
+				"usr/bin/b":    "linked",
+				"dev/console":  "character device 0:0\n",
+				"bin/true":     "binary",
+			},
+			wantLinks: map[string]string{"bin": "usr/bin"},
+		},
+		"dot dot": {
+			entries: []it.CPIOEntry{{Name: "../evil", Mode: 0o100644, Data: []byte("evil")}},
+			wantErr: true,
+		},
+		"through symlink": {
+			entries: []it.CPIOEntry{
+				{Name: "lib", Mode: 0o120777, Data: []byte("/tmp")},
+				{Name: "lib/evil", Mode: 0o100644, Data: []byte("evil")},
+			},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			x := &extractor{dir: dir, links: make(map[hardlinkKey]string)}
+			err := initrd.WalkCPIO(bytes.NewReader(it.NewcArchive(tc.entries)), x.extract)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := x.finishDirs(); err != nil {
+				t.Fatal(err)
+			}
+			for path, want := range tc.wantFiles {
+				got, err := os.ReadFile(filepath.Join(dir, path))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != want {
+					t.Errorf("%s: got content %q, want %q", path, got, want)
+				}
+			}
+			for path, want := range tc.wantLinks {
+				got, err := os.Readlink(filepath.Join(dir, path))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Errorf("%s: got link target %q, want %q", path, got, want)
+				}
+			}
+			fi, err := os.Stat(filepath.Join(dir, "etc"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != 0o750 {
+				t.Errorf("got mode %v of directory etc, want 0750", fi.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestListEntry(t *testing.T) {
+	archive := it.NewcArchive([]it.CPIOEntry{
+		{Name: "etc", Mode: 0o42750},
+		{Name: "etc/hostname", Mode: 0o104644, Data: []byte("initrd\n")},
+		{Name: "bin", Mode: 0o120777, Data: []byte("usr/bin")},
+		{Name: "tmp", Mode: 0o41777},
+	})
+	var out bytes.Buffer
+	if err := initrd.WalkCPIO(bytes.NewReader(archive), func(hdr *initrd.CPIOHeader, data io.Reader) error {
+		return listEntry(&out, hdr, data)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := "0\tnewc\t0\t042750\tdrwxr-s---\t1\t0\t0\t0\t0\t1970-01-01T00:00:00Z\t0:0\t0:0\t4\t00000000\t-\tetc\n" +
+		"116\tnewc\t1\t104644\t-rwSr--r--\t1\t0\t0\t7\t0\t1970-01-01T00:00:00Z\t0:0\t0:0\t13\t00000000\t" +
+		"8f7ed204b9dfaa20aa484445f54233c4b407cb80ec0f8c07f1f0a59675fb44cf\tetc/hostname\n" +
+		"248\tnewc\t2\t120777\tlrwxrwxrwx\t1\t0\t0\t7\t0\t1970-01-01T00:00:00Z\t0:0\t0:0\t4\t00000000\t" +
+		"51eb85985e2f36e92fb2e18d663412b7bb94839f546901884eda4936683d9481\tbin -> usr/bin\n" +
+		"372\tnewc\t3\t041777\tdrwxrwxrwt\t1\t0\t0\t0\t0\t1970-01-01T00:00:00Z\t0:0\t0:0\t4\t00000000\t-\ttmp\n"
+	if got := out.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLint(t *testing.T) {
+	epoch := int64(1700000000)
+	entries := []initrd.CPIOHeader{
+		{Format: initrd.CPIOFormatNewc, Name: ".", Ino: 1, Mode: 0o40755, Nlink: 2},
+		{Format: initrd.CPIOFormatNewc, Name: "bin", Ino: 2, Mode: 0o120777, Nlink: 1, Mtime: epoch},
+		{Format: initrd.CPIOFormatNewc, Name: "etc", Ino: 3, Mode: 0o40755, Nlink: 2, Mtime: 1},
+		{Format: initrd.CPIOFormatNewc, Name: "etc/a", Ino: 4, Mode: 0o100644, Nlink: 2, UID: 1000},
+		{Format: initrd.CPIOFormatNewc, Name: "etc/b", Ino: 4, Mode: 0o100644, Nlink: 2, DevMajor: 8, DevMinor: 1},
+		{Format: initrd.CPIOFormatNewc, Name: "etc/0", Ino: 9, Mode: 0o100644, Nlink: 1, Check: 5},
+		{Format: initrd.CPIOFormatCRC, Name: "etc/c", Ino: 10, Mode: 0o100644, Nlink: 1, Check: 5},
+	}
+	l := &linter{epoch: &epoch, inodes: make(map[uint64]bool)}
+	for i := range entries {
+		if err := l.check(&entries[i], nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	for _, f := range l.findings {
+		got = append(got, f.Name+" "+f.Check)
+	}
+	want := []string{"etc mtime", "etc/a owner", "etc/b dev", "etc/0 ino", "etc/0 order", "etc/0 check"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got findings %q, want %q", got, want)
+	}
+}
+
+func TestNormalizeEntries(t *testing.T) {
+	epoch := int64(1700000000)
+	build1 := []cpioFile{
+		{&initrd.CPIOHeader{Format: initrd.CPIOFormatNewc, Name: "etc", Ino: 7, Mode: 0o40755, Nlink: 2, Mtime: epoch + 10}, nil},
+		{&initrd.CPIOHeader{Format: initrd.CPIOFormatNewc, Name: ".", Ino: 5, Mode: 0o40755, Nlink: 2, UID: 1000}, nil},
+		{&initrd.CPIOHeader{Format: initrd.CPIOFormatNewc, Name: "etc/b", Ino: 9, Mode: 0o100644, Nlink: 2, DevMajor: 8, DevMinor: 1}, nil},
+		{&initrd.CPIOHeader{Format: initrd.CPIOFormatNewc, Name: "etc/a", Ino: 9, Mode: 0o100644, Nlink: 2, DevMajor: 8, DevMinor: 1}, []byte("linked")},
+		{&initrd.CPIOHeader{Format: initrd.CPIOFormatNewc, Name: "dev/console", Ino: 3, Mode: 0o20600, Nlink: 1, RDevMajor: 5, RDevMinor: 1}, nil},
+		{&initrd.CPIOHeader{Format: initrd.CPIOFormatNewc, Name: "etc/hostname", Ino: 4, Mode: 0o100644, Nlink: 1, Mtime: 1, GID: 5}, []byte("initrd\n")},
+	}
+	build2 := []cpioFile{
+		{&initrd.CPIOHeader{Format: initrd.CPIOFormatCRC, Name: ".", Ino: 1, Mode: 0o40755, Nlink: 2, Check: 0}, nil},
+		{&initrd.CPIOHeader{Format: initrd.CPIOFormatCRC, Name: "dev/console", Ino: 2, Mode: 0o20600, Nlink: 1, RDevMajor: 5, RDevMinor: 1}, nil},
+		{&initrd.CPIOHeader{Format: initrd.CPIOFormatCRC, Name: "etc", Ino: 3, Mode: 0o40755, Nlink: 2, Mtime: epoch + 20}, nil},
+		{&initrd.CPIOHeader{Format: initrd.CPIOFormatCRC, Name: "etc/a", Ino: 4, Mode: 0o100644, Nlink: 2}, nil},
+		{&initrd.CPIOHeader{Format: initrd.CPIOFormatCRC, Name: "etc/b", Ino: 4, Mode: 0o100644, Nlink: 2}, []byte("linked")},
+		{&initrd.CPIOHeader{Format: initrd.CPIOFormatCRC, Name: "etc/hostname", Ino: 5, Mode: 0o100644, Nlink: 1, Mtime: 1, Check: 0x2a7}, []byte("initrd\n")},
+	}
+
+	archive := func(files []cpioFile) []byte {
+		var b bytes.Buffer
+		for _, f := range normalizeEntries(files, epoch) {
+			if err := initrd.WriteNewcEntry(&b, f.hdr, f.data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := initrd.WriteNewcTrailer(&b); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+	a1, a2 := archive(build1), archive(build2)
+	if !bytes.Equal(a1, a2) {
+		t.Fatalf("normalized archives differ:\n%q\n%q", a1, a2)
+	}
+
+	var got []string
+	l := &linter{epoch: &epoch, inodes: make(map[uint64]bool)}
+	if err := initrd.WalkCPIO(bytes.NewReader(a1), func(hdr *initrd.CPIOHeader, data io.Reader) error {
+		b, err := io.ReadAll(data)
+		if err != nil {
+			return err
+		}
+		got = append(got, fmt.Sprintf("%s %d %d %q", hdr.Name, hdr.Ino, hdr.Mtime, b))
+		return l.check(hdr, nil)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		". 1 0 \"\"",
+		"dev/console 2 0 \"\"",
+		"etc 3 1700000000 \"\"",
+		"etc/a 4 0 \"\"",
+		"etc/b 4 0 \"linked\"",
+		"etc/hostname 5 1 \"initrd\\n\"",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got entries:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	// Only the clamped modification time of etc/hostname remains.
+	if len(l.findings) != 1 || l.findings[0].Name != "etc/hostname" {
+		t.Errorf("unexpected lint findings %+v", l.findings)
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	var b bytes.Buffer
+	for _, e := range []struct {
+		name  string
+		mode  int
+		data  string
+		check int
+	}{
+		{name: ".", mode: 0o40755},
+		{name: "etc/hostname", mode: 0o100644, data: "initrd\n", check: 0x294},
+		{name: "etc/corrupted", mode: 0o100644, data: "initrd\n", check: 0x295},
+		{name: "bin", mode: 0o120777, data: "usr/bin", check: 0},
+		{name: "TRAILER!!!"},
+	} {
+		offset := b.Len()
+		fmt.Fprintf(&b, "070702%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+			1, e.mode, 0, 0, 1, 0, len(e.data), 0, 0, 0, 0, len(e.name)+1, e.check)
+		b.WriteString(e.name + "\x00")
+		b.Write(make([]byte, initrd.PadTo(int64(b.Len()-offset), 4)))
+		b.WriteString(e.data)
+		b.Write(make([]byte, initrd.PadTo(int64(len(e.data)), 4)))
+	}
+
+	checked, mismatches, err := verifyChecksums(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 2 {
+		t.Errorf("checked %d entries, want 2", checked)
+	}
+	want := []checksumMismatch{{Offset: 244, Name: "etc/corrupted", Header: 0x295, Data: 0x294}}
+	if !slices.Equal(mismatches, want) {
+		t.Errorf("got mismatches %+v, want %+v", mismatches, want)
+	}
+
+	if _, _, err := verifyChecksums(bytes.NewReader(b.Bytes()[:300])); err == nil {
+		t.Error("expected error for truncated archive")
+	}
+}
+
+func TestDiffSegment(t *testing.T) {
+	entry := func(name string, ino uint64, mtime int64, data string) cpioEntry {
+		return cpioEntry{
+			hdr:    &initrd.CPIOHeader{Format: initrd.CPIOFormatNewc, Name: name, Ino: ino, Mode: 0o100644, Mtime: mtime},
+			sha256: sha256.Sum256([]byte(data)),
+		}
+	}
+	a := []cpioEntry{
+		entry("a", 1, 0, "a"),
+		entry("b", 2, 0, "b"),
+		entry("c", 3, 0, "c"),
+		entry("d", 4, 0, "d"),
+	}
+	b := []cpioEntry{
+		entry("a", 1, 0, "a"),
+		entry("c", 3, 5, "c"),
+		entry("b", 2, 0, "B"),
+		entry("e", 5, 0, "e"),
+		entry("e", 5, 0, "e"),
+	}
+
+	want := []string{
+		"removed d",
+		"added e",
+		"added e[#2]",
+		fmt.Sprintf("content b: sha256 %x -> %x", sha256.Sum256([]byte("b")), sha256.Sum256([]byte("B"))),
+		"order b: position 1 -> 2",
+		"metadata c: mtime 0 -> 5",
+		"order c: position 2 -> 1",
+	}
+	if got := diffSegment(a, b); !slices.Equal(got, want) {
+		t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if got := diffSegment(a, a); len(got) != 0 {
+		t.Errorf("got differences for identical segments: %q", got)
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	entry := func(name, data string) cpioEntry {
+		return cpioEntry{
+			hdr:    &initrd.CPIOHeader{Format: initrd.CPIOFormatNewc, Name: name, Mode: 0o100644, NameSize: uint32(len(name) + 1), FileSize: int64(len(data))},
+			sha256: sha256.Sum256([]byte(data)),
+		}
+	}
+	segment := func(index int, digest string, compressedSize, size int64) initrd.Segment {
+		return initrd.Segment{Index: index, SHA256: digest, CompressedSize: compressedSize, Size: size}
+	}
+	segments := []initrd.Segment{
+		segment(0, "a", 100, 1000),
+		segment(1, "a", 110, 1000),
+		segment(2, "b", 50, 500),
+		segment(3, "c", 200, 1000),
+		segment(4, "d", 10, 100),
+	}
+	entries := [][]cpioEntry{
+		{entry("x", "x"), entry("y", "y")},
+		{entry("x", "x"), entry("y", "y")},
+		{entry("y", "y")},
+		// 116 of 1000 bytes are duplicated.
+		{entry("x", "x"), entry("z", "y"), entry("w", "1234567890")},
+		{entry("v", "v")},
+	}
+
+	var b strings.Builder
+	total := findDuplicates(&b, segments, entries)
+	want := `identical: initrd_1 is identical to initrd_0 (sha256 a), wasting 110 compressed bytes
+overlap: initrd_0 and initrd_2 share 1 paths, 1 identical entries and 1 file contents
+subset: initrd_2 is contained in initrd_0, wasting 50 compressed bytes
+overlap: initrd_0 and initrd_3 share 1 paths, 1 identical entries and 2 file contents
+partial: 116 bytes of initrd_3 duplicate initrd_0, wasting about 23 compressed bytes
+overlap: initrd_2 and initrd_3 share 0 paths, 0 identical entries and 1 file contents
+total: 183 compressed bytes wasted
+`
+	if b.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+	if total != 183 {
+		t.Errorf("got %d wasted bytes, want 183", total)
+	}
+}
+
+func TestRepackInitrd(t *testing.T) {
+	archive := it.NewcArchive([]it.CPIOEntry{{Name: "etc/hostname", Mode: 0o100644, Data: []byte("initrd\n")}})
+	replacement := it.NewcArchive([]it.CPIOEntry{{Name: "etc/hostname", Mode: 0o100644, Data: []byte("patched\n")}})
+	in := slices.Concat(archive, it.CompressWith(t, archive, gzip.NewWriter), make([]byte, 3), archive)
+
+	segments, err := readInitrdSegments(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &manifest{Size: int64(len(in)), Segments: segments}
+
+	t.Run("identical", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := repackInitrd(m, bytes.NewReader(in), nil, &out); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), in) {
+			t.Error("repacked initrd differs from input")
+		}
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := repackInitrd(m, bytes.NewReader(in), map[int][]byte{1: replacement}, &out); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readInitrdSegments(out.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(replacement)
+		if len(got) != 3 || got[1].Compression != "gzip" || got[1].SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("unexpected segments after replacing: %+v", got)
+		}
+		if got[2].Offset%4 != 0 {
+			t.Errorf("segment following the replacement starts at unaligned offset %d", got[2].Offset)
+		}
+	})
+
+	t.Run("modified input", func(t *testing.T) {
+		modified := bytes.Clone(in)
+		modified[len(modified)-1] ^= 1
+		if err := repackInitrd(m, bytes.NewReader(modified), nil, io.Discard); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
+
+// readInitrdSegments describes the initrds in b, discarding their content.
+func readInitrdSegments(b []byte) ([]initrdSegment, error) {
+	var segments []initrdSegment
+	for seg, err := range initrd.NewReader(bytes.NewReader(b)).Segments() {
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(io.Discard, seg.Content); err != nil {
+			return nil, err
+		}
+		segments = append(segments, initrdSegment{Segment: *seg})
+	}
+	return segments, nil
+}
+
+func TestReadModuleEntry(t *testing.T) {
+	modinfo := "license=GPL\x00depends=\x00name=dummy\x00vermagic=6.11.2 SMP preempt mod_unload \x00\x00\x00"
+	module := elfWithSection(t, ".modinfo", []byte(modinfo))
+
+	issuer, err := asn1.Marshal(pkix.Name{CommonName: "Build time autogenerated kernel key"}.ToRDNSequence())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid, err := asn1.Marshal(pkcs7IssuerAndSerialNumber{Issuer: asn1.RawValue{FullBytes: issuer}, SerialNumber: big.NewInt(0x1234)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha256OID := asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	signedData, err := asn1.Marshal(pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: sha256OID}},
+		ContentInfo:      pkcs7ContentInfo{ContentType: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}},
+		SignerInfos: []pkcs7SignerInfo{{
+			Version:                   1,
+			SID:                       asn1.RawValue{FullBytes: sid},
+			DigestAlgorithm:           pkix.AlgorithmIdentifier{Algorithm: sha256OID},
+			DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}},
+			EncryptedDigest:           []byte("signature"),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData}
+	sig, err := asn1.Marshal(pkcs7ContentInfo{ContentType: oidSignedData, Content: content})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := append(slices.Clone(module), sig...)
+	signed = append(signed, 0, 0, 2, 0, 0, 0, 0, 0)
+	signed = binary.BigEndian.AppendUint32(signed, uint32(len(sig)))
+	signed = append(signed, moduleSignatureMagic...)
+	signedDigest := sha256.Sum256(signed)
+
+	wantSignature := &moduleSignature{
+		Signer:   "Build time autogenerated kernel key",
+		ID:       "PKCS#7",
+		Key:      "12:34",
+		HashAlgo: "sha256",
+	}
+	testCases := map[string]struct {
+		name    string
+		data    []byte
+		want    moduleEntry
+		wantErr bool
+	}{
+		"unsigned zstd module": {
+			name: "usr/lib/modules/6.11.2/kernel/drivers/dummy.ko.zst",
+			data: it.CompressWith(t, module, it.NewZstdWriter(t)),
+			want: moduleEntry{
+				Type:     moduleTypeModule,
+				Path:     "usr/lib/modules/6.11.2/kernel/drivers/dummy.ko.zst",
+				Size:     int64(len(module)),
+				SHA256:   fmt.Sprintf("%x", sha256.Sum256(module)),
+				Name:     "dummy",
+				Vermagic: "6.11.2 SMP preempt mod_unload ",
+				License:  "GPL",
+			},
+		},
+		"signed xz module": {
+			name: "/lib/modules/6.11.2/kernel/drivers/dummy.ko.xz",
+			data: it.CompressWith(t, signed, func(w io.Writer) *xz.Writer {
+				xw, err := xz.WriterConfig{CheckSum: xz.CRC32}.NewWriter(w)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return xw
+			}),
+			want: moduleEntry{
+				Type:            moduleTypeModule,
+				Path:            "lib/modules/6.11.2/kernel/drivers/dummy.ko.xz",
+				Size:            int64(len(signed)),
+				SHA256:          hex.EncodeToString(signedDigest[:]),
+				Name:            "dummy",
+				Vermagic:        "6.11.2 SMP preempt mod_unload ",
+				License:         "GPL",
+				moduleSignature: wantSignature,
+			},
+		},
+		"firmware": {
+			name: "usr/lib/firmware/regulatory.db",
+			data: []byte("db"),
+			want: moduleEntry{
+				Type:   moduleTypeFirmware,
+				Path:   "usr/lib/firmware/regulatory.db",
+				Size:   2,
+				SHA256: fmt.Sprintf("%x", sha256.Sum256([]byte("db"))),
+			},
+		},
+		"no module": {
+			name: "etc/hostname",
+			data: []byte("initrd"),
+		},
+		"not an ELF file": {
+			name: "usr/lib/modules/6.11.2/kernel/drivers/dummy.ko",
+			data: []byte("not an ELF file"),
+			want: moduleEntry{
+				Type:   moduleTypeModule,
+				Path:   "usr/lib/modules/6.11.2/kernel/drivers/dummy.ko",
+				Size:   15,
+				SHA256: fmt.Sprintf("%x", sha256.Sum256([]byte("not an ELF file"))),
+			},
+			wantErr: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			hdr := &initrd.CPIOHeader{Name: tc.name, Mode: initrd.CPIOModeRegular | 0o644, FileSize: int64(len(tc.data))}
+			got, ok, err := readModuleEntry(hdr, bytes.NewReader(tc.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Modules that can't be parsed are still listed.
+			if tc.wantErr != (got.Error != "") {
+				t.Errorf("got error %q, want error: %v", got.Error, tc.wantErr)
+			}
+			got.Error = ""
+			if !ok {
+				got = moduleEntry{}
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+// elfWithSection returns a minimal ELF object file with a single section.
+func elfWithSection(t *testing.T, name string, data []byte) []byte {
+	shstrtab := []byte("\x00" + name + "\x00.shstrtab\x00")
+	headerSize := int64(binary.Size(elf.Header64{}))
+	shoff := headerSize + int64(len(data)) + int64(len(shstrtab))
+	shoff += initrd.PadTo(shoff, 8)
+
+	var b bytes.Buffer
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_REL),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     uint64(shoff),
+		Ehsize:    uint16(headerSize),
+		Shentsize: uint16(binary.Size(elf.Section64{})),
+		Shnum:     3,
+		Shstrndx:  2,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	sections := []elf.Section64{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_PROGBITS), Off: uint64(headerSize), Size: uint64(len(data)), Addralign: 1},
+		{Name: uint32(len(name) + 2), Type: uint32(elf.SHT_STRTAB), Off: uint64(headerSize) + uint64(len(data)), Size: uint64(len(shstrtab)), Addralign: 1},
+	}
+	for _, v := range []any{hdr, data, shstrtab, make([]byte, shoff-headerSize-int64(len(data))-int64(len(shstrtab))), sections} {
+		if err := binary.Write(&b, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b.Bytes()
+}
+
+func TestSeparateInitrds(t *testing.T) {
+	microcode := it.NewcArchive([]it.CPIOEntry{
+		{Name: "kernel/x86/microcode/AuthenticAMD.bin", Mode: 0o100644},
+	})
+	main := it.NewcArchive([]it.CPIOEntry{{Name: "init", Mode: 0o100755, Data: []byte("#!/bin/sh\n")}})
+	in := slices.Concat(microcode, it.CompressWith(t, main, gzip.NewWriter), []byte("garbage"))
+
+	separate := func(opts separateOptions) ([]string, string, error) {
+		segments, remaining, err := separateInitrds(initrd.NewReader(bytes.NewReader(in)), opts)
+		var paths []string
+		for _, seg := range segments {
+			paths = append(paths, seg.Output)
+		}
+		return paths, remaining, err
+	}
+
+	t.Run("descriptive names", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "out")
+		paths, remaining, err := separate(separateOptions{OutDir: dir, Descriptive: true})
+		if err == nil {
+			t.Fatal("expected error for garbage at the end")
+		}
+		want := []string{filepath.Join(dir, "00-early-microcode.cpio"), filepath.Join(dir, "01-main-gzip.cpio")}
+		if !slices.Equal(paths, want) {
+			t.Errorf("got outputs %q, want %q", paths, want)
+		}
+		for i, content := range [][]byte{microcode, main} {
+			if got, err := os.ReadFile(want[i]); err != nil || !bytes.Equal(got, content) {
+				t.Errorf("unexpected content of %s: %v", want[i], err)
+			}
+		}
+		if got, err := os.ReadFile(remaining); err != nil || string(got) != "garbage" {
+			t.Errorf("got remaining data %q, %v", got, err)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 3 {
+			t.Errorf("got %d files in output directory, want 3", len(entries))
+		}
+	})
+
+	t.Run("force", func(t *testing.T) {
+		dir := t.TempDir()
+		if _, _, err := separate(separateOptions{OutDir: dir, Extract: true}); err == nil {
+			t.Fatal("expected error for garbage at the end")
+		}
+		if _, _, err := separate(separateOptions{OutDir: dir, Extract: true}); err == nil ||
+			!strings.Contains(err.Error(), "already exists") {
+			t.Fatalf("got %v, want error for existing output", err)
+		}
+		paths, _, _ := separate(separateOptions{OutDir: dir, Extract: true, Force: true})
+		want := []string{filepath.Join(dir, "initrd_0"), filepath.Join(dir, "initrd_1")}
+		if !slices.Equal(paths, want) {
+			t.Errorf("got outputs %q, want %q", paths, want)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "initrd_1", "init")); err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/katexochen/image-tools/initrdsep/initrd"
+)
+
+// manifest describes how an initrd file was separated.
+type manifest struct {
+	// Input is the absolute path of the separated file, or "-" for stdin.
+	Input    string          `json:"input"`
+	Size     int64           `json:"size"`
+	SHA256   string          `json:"sha256"`
+	Segments []initrdSegment `json:"segments"`
+}
+
+// writeManifest writes the manifest for the segments separated from the
+// input at inputPath as JSON to the file at path. The input must have been
+// consumed completely.
+func writeManifest(path, inputPath string, in *initrd.Reader, segments []initrdSegment) error {
+	input := inputPath
+	if input != "-" {
+		var err error
+		if input, err = filepath.Abs(inputPath); err != nil {
+			return err
+		}
+	}
+	if segments == nil {
+		segments = []initrdSegment{}
+	}
+	size, digest := in.InputDigest()
+
+	data, err := json.MarshalIndent(manifest{
+		Input:    input,
+		Size:     size,
+		SHA256:   hex.EncodeToString(digest),
+		Segments: segments,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+func readManifest(path string) (*manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("parsing manifest: %w", err)
+	}
+	return &m, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509/pkix"
+	"debug/elf"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// moduleSignatureMagic terminates a kernel module with an appended signature.
+const moduleSignatureMagic = "~Module signature appended~\n"
+
+// moduleSignature describes the signature appended to a kernel module.
+type moduleSignature struct {
+	// Signer is the common name of the certificate issuer for PKCS#7
+	// signatures.
+	Signer string `json:"signer"`
+	// ID is the signature type, usually PKCS#7.
+	ID string `json:"sig_id"`
+	// Key identifies the signing key, the serial number of the certificate
+	// for PKCS#7 signatures.
+	Key      string `json:"sig_key"`
+	HashAlgo string `json:"sig_hashalgo"`
+}
+
+// splitModuleSignature splits a kernel module into the module and the
+// appended signature. The signature is nil for unsigned modules.
+// https://elixir.bootlin.com/linux/v6.11.2/source/include/linux/module_signature.h
+func splitModuleSignature(data []byte) ([]byte, *moduleSignature, error) {
+	const infoSize = 12
+	if !bytes.HasSuffix(data, []byte(moduleSignatureMagic)) {
+		return data, nil, nil
+	}
+	data = data[:len(data)-len(moduleSignatureMagic)]
+	if len(data) < infoSize {
+		return nil, nil, errors.New("truncated module signature info")
+	}
+	info := data[len(data)-infoSize:]
+	data = data[:len(data)-infoSize]
+	// The first byte, the public key algorithm, is unused.
+	hash, idType := info[1], info[2]
+	signerLen, keyIDLen := int(info[3]), int(info[4])
+	sigLen := int64(binary.BigEndian.Uint32(info[8:]))
+	if sigLen+int64(signerLen+keyIDLen) > int64(len(data)) {
+		return nil, nil, fmt.Errorf("module signature size %d exceeds module", sigLen)
+	}
+	sig := data[int64(len(data))-sigLen:]
+	data = data[:int64(len(data))-sigLen]
+
+	const (
+		idPGP   = 0
+		idX509  = 1
+		idPKCS7 = 2
+	)
+	switch idType {
+	case idPKCS7:
+		s, err := parsePKCS7Signature(sig)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing PKCS#7 module signature: %w", err)
+		}
+		return data, s, nil
+	case idPGP, idX509:
+		// The deprecated formats store the signer name and key ID in front
+		// of the signature.
+		keyID := data[len(data)-keyIDLen:]
+		signer := data[len(data)-keyIDLen-signerLen : len(data)-keyIDLen]
+		data = data[:len(data)-keyIDLen-signerLen]
+		s := &moduleSignature{
+			Signer:   string(signer),
+			ID:       map[byte]string{idPGP: "PGP", idX509: "X509"}[idType],
+			Key:      hexColon(keyID),
+			HashAlgo: kernelHashAlgo(hash),
+		}
+		return data, s, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown module signature type %d", idType)
+	}
+}
+
+// kernelHashAlgo returns the name of a hash algorithm in the kernel's
+// enum hash_algo.
+func kernelHashAlgo(id byte) string {
+	names := []string{"md4", "md5", "sha1", "rmd160", "sha256", "sha384", "sha512", "sha224"}
+	if int(id) < len(names) {
+		return names[id]
+	}
+	return fmt.Sprintf("unknown(%d)", id)
+}
+
+// PKCS#7 structures, as far as needed to identify the signer.
+// https://www.rfc-editor.org/rfc/rfc2315
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      pkcs7ContentInfo
+	Certificates     asn1.RawValue     `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue     `asn1:"optional,tag:1"`
+	SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+}
+
+type pkcs7SignerInfo struct {
+	Version                   int
+	SID                       asn1.RawValue
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type pkcs7IssuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+var oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+var digestAlgorithmNames = map[string]string{
+	"1.3.14.3.2.26":           "sha1",
+	"2.16.840.1.101.3.4.2.1":  "sha256",
+	"2.16.840.1.101.3.4.2.2":  "sha384",
+	"2.16.840.1.101.3.4.2.3":  "sha512",
+	"2.16.840.1.101.3.4.2.4":  "sha224",
+	"2.16.840.1.101.3.4.2.8":  "sha3-256",
+	"2.16.840.1.101.3.4.2.9":  "sha3-384",
+	"2.16.840.1.101.3.4.2.10": "sha3-512",
+}
+
+// parsePKCS7Signature extracts the signer of a PKCS#7 module signature, like
+// modinfo does from the first signer info.
+func parsePKCS7Signature(der []byte) (*moduleSignature, error) {
+	var ci pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, err
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("unexpected content type %s", ci.ContentType)
+	}
+	// The raw value is the explicit tag around the signed data.
+	var sd pkcs7SignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, err
+	}
+	if len(sd.SignerInfos) == 0 {
+		return nil, errors.New("no signer info")
+	}
+	si := sd.SignerInfos[0]
+	s := &moduleSignature{ID: "PKCS#7", HashAlgo: si.DigestAlgorithm.Algorithm.String()}
+	if name, ok := digestAlgorithmNames[s.HashAlgo]; ok {
+		s.HashAlgo = name
+	}
+
+	switch {
+	case si.SID.Class == asn1.ClassUniversal && si.SID.Tag == asn1.TagSequence:
+		var ias pkcs7IssuerAndSerialNumber
+		if _, err := asn1.Unmarshal(si.SID.FullBytes, &ias); err != nil {
+			return nil, fmt.Errorf("parsing signer identifier: %w", err)
+		}
+		var rdns pkix.RDNSequence
+		if _, err := asn1.Unmarshal(ias.Issuer.FullBytes, &rdns); err != nil {
+			return nil, fmt.Errorf("parsing issuer: %w", err)
+		}
+		var issuer pkix.Name
+		issuer.FillFromRDNSequence(&rdns)
+		s.Signer = issuer.CommonName
+		s.Key = hexColon(ias.SerialNumber.Bytes())
+	case si.SID.Class == asn1.ClassContextSpecific && si.SID.Tag == 0:
+		// The signer is identified by the subject key identifier.
+		s.Key = hexColon(si.SID.Bytes)
+	default:
+		return nil, fmt.Errorf("unknown signer identifier tag %d", si.SID.Tag)
+	}
+	return s, nil
+}
+
+// hexColon formats b like modinfo, as colon separated upper case hex bytes.
+func hexColon(b []byte) string {
+	parts := make([]string, len(b))
+	for i, c := range b {
+		parts[i] = fmt.Sprintf("%02X", c)
+	}
+	return strings.Join(parts, ":")
+}
+
+// parseModinfo returns the key value pairs of the .modinfo section of a
+// kernel module. Keys like depends or alias may occur multiple times.
+func parseModinfo(module []byte) ([][2]string, error) {
+	f, err := elf.NewFile(bytes.NewReader(module))
+	if err != nil {
+		return nil, err
+	}
+	section := f.Section(".modinfo")
+	if section == nil {
+		return nil, errors.New("module has no .modinfo section")
+	}
+	data, err := section.Data()
+	if err != nil {
+		return nil, fmt.Errorf("reading .modinfo: %w", err)
+	}
+	var info [][2]string
+	for _, field := range bytes.Split(data, []byte{0}) {
+		// Fields are NUL terminated and may be padded with NULs.
+		if len(field) == 0 {
+			continue
+		}
+		key, value, _ := strings.Cut(string(field), "=")
+		info = append(info, [2]string{key, value})
+	}
+	return info, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/katexochen/image-tools/initrdsep/initrd"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// moduleEntry is a kernel module or firmware file found in an initrd.
+type moduleEntry struct {
+	Initrd int    `json:"initrd"`
+	Type   string `json:"type"`
+	Path   string `json:"path"`
+	// Size and SHA256 describe the decompressed module, or the firmware
+	// file as stored.
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+
+	// Fields of the .modinfo section of modules.
+	Name     string `json:"name,omitempty"`
+	Vermagic string `json:"vermagic,omitempty"`
+	Depends  string `json:"depends,omitempty"`
+	License  string `json:"license,omitempty"`
+	// The signature is nil for unsigned modules.
+	*moduleSignature
+	// Error tells why a module couldn't be read, the fields above it are
+	// set as far as they were read.
+	Error string `json:"error,omitempty"`
+}
+
+const (
+	moduleTypeModule   = "module"
+	moduleTypeFirmware = "firmware"
+)
+
+// modules lists the kernel modules and firmware files in the initrds in the
+// file at args[0]. Modules are decompressed to report their .modinfo fields
+// and appended signature like modinfo does. Modules that can't be read are
+// listed and reported, and make the command fail at the end.
+func modules(args []string) error {
+	flags := flag.NewFlagSet(os.Args[0]+" modules", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print each entry as a JSON object on its own line")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: %s modules [-json] <path|->", os.Args[0])
+	}
+	setProgress(os.Stderr)
+
+	f, err := openInput(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	defer w.Flush()
+	enc := json.NewEncoder(os.Stdout)
+	if !*asJSON {
+		fmt.Fprintln(w, "INITRD\tTYPE\tNAME\tVERMAGIC\tDEPENDS\tLICENSE\tSIGNER\tSIG_ID\tPATH")
+	}
+	printEntry := func(e moduleEntry) error {
+		if *asJSON {
+			return enc.Encode(e)
+		}
+		var sig moduleSignature
+		if e.moduleSignature != nil {
+			sig = *e.moduleSignature
+		}
+		_, err := fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Initrd, e.Type,
+			orDash(e.Name), orDash(e.Vermagic), orDash(e.Depends), orDash(e.License),
+			orDash(sig.Signer), orDash(sig.ID), e.Path)
+		return err
+	}
+
+	var failed int
+	for seg, err := range initrd.NewReader(f).Segments() {
+		if err != nil {
+			return err
+		}
+		if err := initrd.WalkCPIO(seg.Content, func(hdr *initrd.CPIOHeader, data io.Reader) error {
+			e, ok, err := readModuleEntry(hdr, data)
+			if err != nil {
+				return fmt.Errorf("initrd_%d: %s: %w", seg.Index, hdr.Name, err)
+			}
+			if !ok {
+				return nil
+			}
+			e.Initrd = seg.Index
+			if e.Error != "" {
+				fmt.Fprintf(progress, "initrd_%d: %s: %s\n", seg.Index, hdr.Name, e.Error)
+				failed++
+			}
+			return printEntry(e)
+		}); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d modules couldn't be read", failed)
+	}
+	return nil
+}
+
+// readModuleEntry describes the cpio entry hdr if it is a kernel module or a
+// firmware file. Modules whose content can't be parsed are described with
+// their Error set, only failing to read data is returned as error.
+func readModuleEntry(hdr *initrd.CPIOHeader, data io.Reader) (moduleEntry, bool, error) {
+	name := strings.TrimPrefix(strings.TrimLeft(hdr.Name, "/"), "./")
+	if hdr.FileType() != initrd.CPIOModeRegular {
+		return moduleEntry{}, false, nil
+	}
+	e := moduleEntry{Path: name}
+	switch {
+	case isFirmwarePath(name):
+		e.Type = moduleTypeFirmware
+		h := sha256.New()
+		n, err := io.Copy(h, data)
+		if err != nil {
+			return e, false, err
+		}
+		e.Size, e.SHA256 = n, hex.EncodeToString(h.Sum(nil))
+		return e, true, nil
+	case moduleSuffix(name) != "":
+		e.Type = moduleTypeModule
+	default:
+		return e, false, nil
+	}
+
+	compressed, err := io.ReadAll(data)
+	if err != nil {
+		return e, false, err
+	}
+	module, err := decompressModule(moduleSuffix(name), compressed)
+	if err != nil {
+		e.Error = fmt.Sprintf("decompressing module: %v", err)
+		return e, true, nil
+	}
+	digest := sha256.Sum256(module)
+	e.Size, e.SHA256 = int64(len(module)), hex.EncodeToString(digest[:])
+
+	module, e.moduleSignature, err = splitModuleSignature(module)
+	if err != nil {
+		e.Error = err.Error()
+		return e, true, nil
+	}
+	info, err := parseModinfo(module)
+	if err != nil {
+		e.Error = err.Error()
+		return e, true, nil
+	}
+	var depends []string
+	for _, kv := range info {
+		switch kv[0] {
+		case "name":
+			e.Name = kv[1]
+		case "vermagic":
+			e.Vermagic = kv[1]
+		case "depends":
+			if kv[1] != "" {
+				depends = append(depends, kv[1])
+			}
+		case "license":
+			e.License = kv[1]
+		}
+	}
+	e.Depends = strings.Join(depends, ",")
+	if e.Name == "" {
+		// Modules built before the name field was added are named after
+		// their file.
+		base := strings.TrimSuffix(path.Base(name), moduleSuffix(name))
+		e.Name = strings.ReplaceAll(base, "-", "_")
+	}
+	return e, true, nil
+}
+
+func isFirmwarePath(name string) bool {
+	return strings.HasPrefix(name, "lib/firmware/") || strings.HasPrefix(name, "usr/lib/firmware/")
+}
+
+// moduleSuffix returns the suffix of a kernel module path, which tells the
+// compression, or "" if the path isn't a module.
+func moduleSuffix(name string) string {
+	for _, suffix := range []string{".ko", ".ko.zst", ".ko.xz", ".ko.gz"} {
+		if strings.HasSuffix(name, suffix) {
+			return suffix
+		}
+	}
+	return ""
+}
+
+// decompressModule decompresses a module compressed as indicated by the
+// suffix of its file.
+func decompressModule(suffix string, data []byte) ([]byte, error) {
+	var r io.Reader
+	switch suffix {
+	case ".ko":
+		return data, nil
+	case ".ko.zst":
+		d, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer d.Close()
+		return d.DecodeAll(data, nil)
+	case ".ko.xz":
+		xr, err := xz.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		r = xr
+	case ".ko.gz":
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		r = gr
+	default:
+		return nil, fmt.Errorf("unknown module suffix %q", suffix)
+	}
+	return io.ReadAll(r)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
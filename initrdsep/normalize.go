@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/katexochen/image-tools/initrdsep/initrd"
+)
+
+// cpioFile is a cpio entry together with its data.
+type cpioFile struct {
+	hdr  *initrd.CPIOHeader
+	data []byte
+}
+
+// normalize rewrites the initrds in the file at args[0] into a canonical
+// form, so builds that only differ in metadata produce identical files. Each
+// initrd is rewritten as a single newc archive, see normalizeEntries, and
+// compressed with a fixed configuration. Uncompressed initrds, like early
+// microcode, stay uncompressed.
+func normalize(args []string) error {
+	flags := flag.NewFlagSet(os.Args[0]+" normalize", flag.ContinueOnError)
+	epoch := flags.Int64("epoch", 0, "clamp modification times to this time, defaults to SOURCE_DATE_EPOCH or 0")
+	compression := flags.String("compression", "zstd", "compression of compressed initrds: zstd, gzip or none")
+	force := flags.Bool("force", false, "overwrite an existing output")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: %s normalize [-epoch <seconds>] [-compression zstd|gzip|none] [-force] <path|-> <out>", os.Args[0])
+	}
+	switch *compression {
+	case "zstd", "gzip", "none":
+	default:
+		return fmt.Errorf("unsupported compression %q", *compression)
+	}
+	epochSet := false
+	flags.Visit(func(f *flag.Flag) { epochSet = epochSet || f.Name == "epoch" })
+	if s, ok := os.LookupEnv("SOURCE_DATE_EPOCH"); ok && !epochSet {
+		e, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("parsing SOURCE_DATE_EPOCH: %w", err)
+		}
+		*epoch = e
+	}
+	setProgress(os.Stderr)
+
+	f, err := openInput(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	out, err := createOutput(flags.Arg(1), *force)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	var written, count int64
+	for seg, err := range initrd.NewReader(f).Segments() {
+		if err != nil {
+			return err
+		}
+		// The entries are kept in memory to sort them.
+		var files []cpioFile
+		if err := initrd.WalkCPIO(seg.Content, func(hdr *initrd.CPIOHeader, data io.Reader) error {
+			b, err := io.ReadAll(data)
+			if err != nil {
+				return fmt.Errorf("reading data of %s: %w", hdr.Name, err)
+			}
+			files = append(files, cpioFile{hdr, b})
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		var archive bytes.Buffer
+		for _, file := range normalizeEntries(files, *epoch) {
+			if err := initrd.WriteNewcEntry(&archive, file.hdr, file.data); err != nil {
+				return err
+			}
+		}
+		if err := initrd.WriteNewcTrailer(&archive); err != nil {
+			return err
+		}
+		segCompression := *compression
+		if seg.Compression == "none" {
+			segCompression = "none"
+		}
+		compressed, err := compressSegment(segCompression, archive.Bytes())
+		if err != nil {
+			return fmt.Errorf("compressing initrd %d: %w", seg.Index, err)
+		}
+		// The kernel expects cpio headers at a multiple of 4 bytes.
+		compressed = append(compressed, make([]byte, initrd.PadTo(written+int64(len(compressed)), 4))...)
+		if _, err := io.MultiWriter(out, h).Write(compressed); err != nil {
+			return err
+		}
+		written += int64(len(compressed))
+		count++
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("normalized %d initrds, sha256 %s\n", count, hex.EncodeToString(h.Sum(nil)))
+	return nil
+}
+
+// normalizeEntries returns the entries sorted by name, with modification
+// times clamped to epoch, inodes numbered consecutively from 1, owner and
+// group root, and the device numbers of regular files zeroed. The data of
+// hard links is stored with the last link, like GNU cpio does.
+func normalizeEntries(files []cpioFile, epoch int64) []cpioFile {
+	type inode struct {
+		devMajor, devMinor uint32
+		ino                uint64
+	}
+	isHardlink := func(hdr *initrd.CPIOHeader) bool {
+		return hdr.FileType() == initrd.CPIOModeRegular && hdr.Nlink > 1
+	}
+	// The data of a hard link may be stored with any of the links.
+	linkData := make(map[inode][]byte)
+	for _, f := range files {
+		if isHardlink(f.hdr) && len(f.data) > 0 {
+			linkData[inode{f.hdr.DevMajor, f.hdr.DevMinor, f.hdr.Ino}] = f.data
+		}
+	}
+
+	sorted := make([]cpioFile, len(files))
+	copy(sorted, files)
+	// Later entries replace earlier ones of the same name when unpacked, so
+	// their order is kept.
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].hdr.Name < sorted[j].hdr.Name })
+
+	inodes := make(map[inode]uint64)
+	lastLink := make(map[inode]int)
+	var nextIno uint64 = 1
+	for i, f := range sorted {
+		hdr := *f.hdr
+		sorted[i] = cpioFile{hdr: &hdr, data: f.data}
+
+		key := inode{hdr.DevMajor, hdr.DevMinor, hdr.Ino}
+		if ino, ok := inodes[key]; ok && isHardlink(&hdr) {
+			hdr.Ino = ino
+		} else {
+			if isHardlink(&hdr) {
+				inodes[key] = nextIno
+			}
+			hdr.Ino = nextIno
+			nextIno++
+		}
+		if isHardlink(&hdr) {
+			sorted[i].data = nil
+			lastLink[key] = i
+		}
+
+		hdr.Mtime = min(hdr.Mtime, epoch)
+		hdr.UID, hdr.GID = 0, 0
+		if hdr.FileType() == initrd.CPIOModeRegular {
+			hdr.DevMajor, hdr.DevMinor = 0, 0
+			hdr.RDevMajor, hdr.RDevMinor = 0, 0
+		}
+		hdr.Format = initrd.CPIOFormatNewc
+		hdr.Check = 0
+	}
+	for key, i := range lastLink {
+		sorted[i].data = linkData[key]
+	}
+	for i := range sorted {
+		sorted[i].hdr.FileSize = int64(len(sorted[i].data))
+	}
+	return sorted
+}
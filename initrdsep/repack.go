@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/katexochen/image-tools/initrdsep/initrd"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// repack rebuilds the initrd file described by a manifest written during
+// separation. Without replacements, the result is verified to be identical to
+// the separated file. Segments can be swapped with -replace N=path, where path
+// is an uncompressed cpio archive.
+func repack(args []string) error {
+	flags := flag.NewFlagSet(os.Args[0]+" repack", flag.ContinueOnError)
+	replacePaths := make(map[int]string)
+	flags.Func("replace", "replace segment N with the cpio archive at path, given as N=path", func(s string) error {
+		index, path, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("expected N=path, got %q", s)
+		}
+		i, err := strconv.Atoi(index)
+		if err != nil {
+			return fmt.Errorf("parsing segment index: %w", err)
+		}
+		replacePaths[i] = path
+		return nil
+	})
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: %s repack [-replace N=path]... <manifest> <out>", os.Args[0])
+	}
+
+	m, err := readManifest(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("reading manifest: %w", err)
+	}
+	replacements := make(map[int][]byte)
+	for i, path := range replacePaths {
+		if i < 0 || i >= len(m.Segments) {
+			return fmt.Errorf("manifest has no segment %d", i)
+		}
+		if replacements[i], err = os.ReadFile(path); err != nil {
+			return fmt.Errorf("reading replacement for segment %d: %w", i, err)
+		}
+	}
+
+	// The separated segments prove that separation was lossless.
+	for _, seg := range m.Segments {
+		if _, ok := replacements[seg.Index]; ok {
+			continue
+		}
+		if err := verifySegmentOutput(seg); err != nil {
+			return fmt.Errorf("verifying segment %d: %w", seg.Index, err)
+		}
+	}
+
+	if m.Input == "-" {
+		return errors.New("the separated initrd was read from stdin and isn't available")
+	}
+	in, err := os.Open(m.Input)
+	if err != nil {
+		return fmt.Errorf("opening separated file: %w", err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(flags.Arg(1), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	if err := repackInitrd(m, in, replacements, io.MultiWriter(out, h)); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	if len(replacements) > 0 {
+		fmt.Printf("repacked initrd with %d replaced segments, sha256 %s\n", len(replacements), digest)
+		return nil
+	}
+	if digest != m.SHA256 {
+		return fmt.Errorf("repacked initrd has sha256 %s, want %s", digest, m.SHA256)
+	}
+	fmt.Printf("repacked initrd is identical to %s\n", m.Input)
+	return nil
+}
+
+// verifySegmentOutput checks that the separated output of seg still has the
+// recorded content. Extracted segments can't be checked.
+func verifySegmentOutput(seg initrdSegment) error {
+	f, err := os.Open(seg.Output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		fmt.Fprintf(progress, "skipping verification of extracted segment %d\n", seg.Index)
+		return nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != seg.SHA256 {
+		return fmt.Errorf("%s has sha256 %s, want %s", seg.Output, got, seg.SHA256)
+	}
+	return nil
+}
+
+// repackInitrd writes the initrd described by m to out. Unchanged segments
+// are copied from in, the original file, after verifying their checksum.
+// Replacements are compressed in the format of the segment they replace.
+func repackInitrd(m *manifest, in io.ReaderAt, replacements map[int][]byte, out io.Writer) error {
+	var offset, written int64
+	for i, seg := range m.Segments {
+		if seg.Index != i || seg.Offset != offset {
+			return fmt.Errorf("segment %d at offset %d doesn't follow the previous segment ending at %d", seg.Index, seg.Offset, offset)
+		}
+		offset += seg.CompressedSize + seg.Padding
+
+		var n int64
+		padding := seg.Padding
+		if data, ok := replacements[i]; ok {
+			compressed, err := compressSegment(seg.Compression, data)
+			if err != nil {
+				return fmt.Errorf("compressing replacement for segment %d: %w", i, err)
+			}
+			if _, err := out.Write(compressed); err != nil {
+				return err
+			}
+			n = int64(len(compressed))
+			// The kernel expects cpio headers at a multiple of 4 bytes.
+			padding = initrd.PadTo(written+n, 4)
+		} else {
+			h := sha256.New()
+			var err error
+			n, err = io.Copy(io.MultiWriter(out, h), io.NewSectionReader(in, seg.Offset, seg.CompressedSize))
+			if err != nil {
+				return fmt.Errorf("copying segment %d: %w", i, err)
+			}
+			if n != seg.CompressedSize {
+				return fmt.Errorf("segment %d is truncated", i)
+			}
+			if got := hex.EncodeToString(h.Sum(nil)); got != seg.CompressedSHA256 {
+				return fmt.Errorf("segment %d has sha256 %s, want %s", i, got, seg.CompressedSHA256)
+			}
+		}
+		if _, err := out.Write(make([]byte, padding)); err != nil {
+			return err
+		}
+		written += n + padding
+	}
+	if offset != m.Size {
+		return fmt.Errorf("segments end at offset %d, but the file has %d bytes", offset, m.Size)
+	}
+	return nil
+}
+
+// compressSegment compresses a cpio archive in the given format. The output
+// only depends on the input, so normalized initrds are reproducible.
+func compressSegment(compression string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch compression {
+	case "none":
+		return data, nil
+	case "gzip":
+		w, err = gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	case "xz":
+		// The kernel only supports the CRC32 check.
+		w, err = xz.WriterConfig{CheckSum: xz.CRC32}.NewWriter(&buf)
+	case "zstd":
+		w, err = zstd.NewWriter(&buf, zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithEncoderConcurrency(1))
+	default:
+		return nil, fmt.Errorf("compressing %s is not supported", compression)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/katexochen/image-tools/initrdsep/initrd"
+)
+
+// checksumMismatch is an entry of a crc archive whose data doesn't match the
+// checksum in its header.
+type checksumMismatch struct {
+	Offset int64
+	Name   string
+	Header uint32
+	Data   uint32
+}
+
+// verify checks the checksums of the entries of crc (070702) archives in the
+// initrds in the file at args[0], and reports every entry whose data doesn't
+// match. Truncated archives are reported as errors.
+func verify(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s verify <path|->", os.Args[0])
+	}
+	setProgress(os.Stderr)
+
+	f, err := openInput(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var checked, mismatches int
+	for seg, err := range initrd.NewReader(f).Segments() {
+		if err != nil {
+			return err
+		}
+		n, found, err := verifyChecksums(seg.Content)
+		if err != nil {
+			return err
+		}
+		for _, m := range found {
+			fmt.Printf("initrd_%d: offset %d: %s: data checksum 0x%08x doesn't match header checksum 0x%08x\n",
+				seg.Index, m.Offset, m.Name, m.Data, m.Header)
+		}
+		checked += n
+		mismatches += len(found)
+	}
+	if mismatches > 0 {
+		return fmt.Errorf("found %d of %d checksummed entries corrupted", mismatches, checked)
+	}
+	fmt.Printf("verified checksums of %d entries\n", checked)
+	return nil
+}
+
+// verifyChecksums checks the entries of crc archives in r. Like the kernel,
+// only the data of regular files is checked. It returns the number of checked
+// entries and those that don't match.
+func verifyChecksums(r io.Reader) (int, []checksumMismatch, error) {
+	var checked int
+	var mismatches []checksumMismatch
+	err := initrd.WalkCPIO(r, func(hdr *initrd.CPIOHeader, data io.Reader) error {
+		if hdr.Format != initrd.CPIOFormatCRC || hdr.FileType() != initrd.CPIOModeRegular {
+			return nil
+		}
+		sum, err := cpioChecksum(data)
+		if err != nil {
+			return fmt.Errorf("reading data of %s: %w", hdr.Name, err)
+		}
+		checked++
+		if sum != hdr.Check {
+			mismatches = append(mismatches, checksumMismatch{
+				Offset: hdr.Offset,
+				Name:   hdr.Name,
+				Header: hdr.Check,
+				Data:   sum,
+			})
+		}
+		return nil
+	})
+	return checked, mismatches, err
+}
+
+// cpioChecksum returns the checksum of crc archives, the sum of all bytes of
+// the data truncated to 32 bits.
+func cpioChecksum(r io.Reader) (uint32, error) {
+	var sum uint32
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			return sum, nil
+		} else if err != nil {
+			return sum, err
+		}
+		sum += uint32(b)
+	}
+}
@@ -0,0 +1,34 @@
+package testing
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressWith compresses content with the writer returned by newWriter.
+func CompressWith[W io.WriteCloser](t testing.TB, content []byte, newWriter func(io.Writer) W) []byte {
+	var buf bytes.Buffer
+	w := newWriter(&buf)
+	if _, err := w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// NewZstdWriter returns a constructor of zstd writers with the given options,
+// for use with CompressWith.
+func NewZstdWriter(t testing.TB, opts ...zstd.EOption) func(io.Writer) *zstd.Encoder {
+	return func(w io.Writer) *zstd.Encoder {
+		zw, err := zstd.NewWriter(w, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return zw
+	}
+}
@@ -0,0 +1,68 @@
+package testing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+)
+
+// CPIOEntry is an entry of a cpio archive built for a test. Entries without
+// an inode number are numbered by their position and have a single link.
+type CPIOEntry struct {
+	Name  string
+	Mode  int
+	Data  []byte
+	Ino   int
+	Nlink int
+}
+
+func withTrailer(entries []CPIOEntry) []CPIOEntry {
+	return append(slices.Clone(entries), CPIOEntry{Name: "TRAILER!!!"})
+}
+
+// NewcArchive returns a cpio archive in the new ascii (newc) format.
+func NewcArchive(entries []CPIOEntry) []byte {
+	var b bytes.Buffer
+	pad := func() { b.Write(make([]byte, (4-b.Len()%4)%4)) }
+	for i, e := range withTrailer(entries) {
+		ino, nlink := i, 1
+		if e.Ino != 0 {
+			ino, nlink = e.Ino, e.Nlink
+		}
+		fmt.Fprintf(&b, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+			ino, e.Mode, 0, 0, nlink, 0, len(e.Data), 0, 0, 0, 0, len(e.Name)+1, 0)
+		b.WriteString(e.Name + "\x00")
+		pad()
+		b.Write(e.Data)
+		pad()
+	}
+	return b.Bytes()
+}
+
+// ODCArchive returns a cpio archive in the portable ascii (odc) format.
+func ODCArchive(entries []CPIOEntry) []byte {
+	var b bytes.Buffer
+	for i, e := range withTrailer(entries) {
+		fmt.Fprintf(&b, "070707%06o%06o%06o%06o%06o%06o%06o%011o%06o%011o",
+			0, i, e.Mode, 0, 0, 1, 0, 0, len(e.Name)+1, len(e.Data))
+		b.WriteString(e.Name + "\x00")
+		b.Write(e.Data)
+	}
+	return b.Bytes()
+}
+
+// BinaryCPIOArchive returns a cpio archive in the old binary format.
+func BinaryCPIOArchive(entries []CPIOEntry, order binary.ByteOrder) []byte {
+	var b bytes.Buffer
+	for i, e := range withTrailer(entries) {
+		header := []uint16{0o70707, 0, uint16(i), uint16(e.Mode), 0, 0, 1, 0, 0, 0,
+			uint16(len(e.Name) + 1), uint16(len(e.Data) >> 16), uint16(len(e.Data))}
+		binary.Write(&b, order, header)
+		b.WriteString(e.Name + "\x00")
+		b.Write(make([]byte, (len(e.Name)+1)%2))
+		b.Write(e.Data)
+		b.Write(make([]byte, len(e.Data)%2))
+	}
+	return b.Bytes()
+}
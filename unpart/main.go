@@ -2,10 +2,14 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"strings"
 
 	"github.com/diskfs/go-diskfs"
 	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+	"github.com/diskfs/go-diskfs/partition/part"
 )
 
 func main() {
@@ -16,10 +20,26 @@ func main() {
 }
 
 func run() error {
-	if len(os.Args) != 2 {
-		return fmt.Errorf("usage: %s <path>", os.Args[0])
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify":
+			return verify(os.Args[2:])
+		case "verity":
+			return verity(os.Args[2:])
+		case "roothash":
+			return roothash(os.Args[2:])
+		}
+	}
+	return unpart(os.Args[1:])
+}
+
+// unpart prints the partitions of the disk at args[0] and extracts them into
+// the working directory.
+func unpart(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s <path> | verify <path> | verity <data> <hash> | roothash <path>", os.Args[0])
 	}
-	path := os.Args[1]
+	path := args[0]
 
 	disk, err := diskfs.Open(path, diskfs.WithOpenMode(diskfs.ReadOnly))
 	if err != nil {
@@ -30,14 +50,37 @@ func run() error {
 	if err != nil {
 		return err
 	}
-	gptTable, ok := table.(*gpt.Table)
-	if !ok {
-		return fmt.Errorf("partition table is not GPT")
-	}
-	if err := inspect(gptTable); err != nil {
-		return err
+	var partitions []namedPartition
+	switch table := table.(type) {
+	case *gpt.Table:
+		if err := inspect(table); err != nil {
+			return err
+		}
+		if err := inspectHybridMBR(disk.File); err != nil {
+			return err
+		}
+		for _, partition := range table.Partitions {
+			partitions = append(partitions, namedPartition{name: partition.Name, Partition: partition})
+		}
+	case *mbr.Table:
+		mbrParts, err := mbrPartitions(disk.File, table, disk.LogicalBlocksize)
+		if err != nil {
+			return err
+		}
+		inspectMBR(table, mbrParts)
+		for _, partition := range mbrParts {
+			// Extended partitions only contain the logical partitions.
+			if isExtended(partition.Type) {
+				continue
+			}
+			// MBR partitions have no names.
+			name := fmt.Sprintf("partition%d", partition.Index)
+			partitions = append(partitions, namedPartition{name: name, Partition: partition})
+		}
+	default:
+		return fmt.Errorf("unsupported partition table type %s", table.Type())
 	}
-	if err := explode(disk.File, gptTable); err != nil {
+	if err := explode(disk.File, partitions); err != nil {
 		return err
 	}
 	return nil
@@ -46,28 +89,78 @@ func run() error {
 func inspect(gptTable *gpt.Table) error {
 	for _, partition := range gptTable.Partitions {
 		fmt.Printf("Partition %s:\n", partition.Name)
-		fmt.Printf("  type: %s\n", partition.Type)
+		if name := partitionTypeName(string(partition.Type)); name != "" {
+			fmt.Printf("  type: %s (%s)\n", name, partition.Type)
+		} else {
+			fmt.Printf("  type: %s\n", partition.Type)
+		}
 		fmt.Printf("  size: %d bytes\n", partition.Size)
 		fmt.Printf("  start: %d\n", partition.Start)
 		fmt.Printf("  end: %d\n", partition.End)
 		fmt.Printf("  guid: %s\n", partition.GUID)
+		if partition.Attributes != 0 {
+			fmt.Printf("  attributes: 0x%016x (%s)\n", partition.Attributes, strings.Join(partitionAttributeNames(partition.Attributes), ", "))
+		}
 	}
 	return nil
 }
 
-func explode(diskFile *os.File, gptTable *gpt.Table) error {
-	for _, partition := range gptTable.Partitions {
-		fmt.Printf("Extracting partition %s\n", partition.Name)
+// inspectMBR prints the partitions of an MBR partition table.
+func inspectMBR(table *mbr.Table, partitions []mbrPartition) {
+	fmt.Printf("MBR disk identifier: 0x%s\n", table.UUID())
+	for _, partition := range partitions {
+		fmt.Printf("Partition %d:\n", partition.Index)
+		fmt.Printf("  type: 0x%02x\n", byte(partition.Type))
+		if isExtended(partition.Type) {
+			fmt.Printf("  extended: true\n")
+		}
+		fmt.Printf("  bootable: %t\n", partition.Bootable)
+		fmt.Printf("  size: %d bytes\n", partition.GetSize())
+		fmt.Printf("  start: %d\n", partition.Start)
+		fmt.Printf("  end: %d\n", partition.Start+partition.Size-1)
+		fmt.Printf("  uuid: %s\n", partition.PartUUID)
+	}
+}
+
+// inspectHybridMBR reports the partitions of a hybrid MBR on a GPT disk.
+func inspectHybridMBR(f io.ReaderAt) error {
+	partitions, err := hybridMBRPartitions(f)
+	if err != nil {
+		return err
+	}
+	if len(partitions) == 0 {
+		return nil
+	}
+	fmt.Printf("Warning: hybrid MBR with %d partitions next to the GPT\n", len(partitions))
+	for _, partition := range partitions {
+		fmt.Printf("  MBR partition: type 0x%02x, bootable %t, start %d, end %d\n",
+			byte(partition.Type), partition.Bootable, partition.Start, partition.Start+partition.Size-1)
+	}
+	return nil
+}
+
+// namedPartition is a partition and the name its contents are extracted to.
+type namedPartition struct {
+	part.Partition
+	name string
+}
+
+func explode(diskFile *os.File, partitions []namedPartition) error {
+	for _, partition := range partitions {
+		fmt.Printf("Extracting partition %s\n", partition.name)
 
-		f, err := os.OpenFile(fmt.Sprintf("%s.part", partition.Name), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
+		f, err := os.OpenFile(fmt.Sprintf("%s.part", partition.name), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
 		if err != nil {
-			return fmt.Errorf("opening new file for partition %s: %w", partition.Name, err)
+			return fmt.Errorf("opening new file for partition %s: %w", partition.name, err)
 		}
 		defer f.Close()
-		if n, err := partition.ReadContents(diskFile, f); err != nil {
-			return fmt.Errorf("copying partition %s: %w", partition.Name, err)
-		} else if n != int64(partition.Size) {
-			return fmt.Errorf("writing partition %s: wrote %d bytes, expected %d", partition.Name, n, partition.Size)
+		// ReadContents of go-diskfs computes MBR offsets in 32 bits, so
+		// partitions beyond 4 GiB would be read from the wrong offset.
+		contents := io.NewSectionReader(diskFile, partition.GetStart(), partition.GetSize())
+		if n, err := io.Copy(f, contents); err != nil {
+			return fmt.Errorf("copying partition %s: %w", partition.name, err)
+		} else if n != partition.GetSize() {
+			return fmt.Errorf("writing partition %s: wrote %d bytes, expected %d", partition.name, n, partition.GetSize())
 		}
 	}
 	return nil
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
+	"reflect"
 	"testing"
 
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+
 	it "github.com/katexochen/image-tools/internal/testing"
 )
 
@@ -24,7 +33,7 @@ func TestUnpart(t *testing.T) {
 			},
 		},
 		// {
-		// 	// Contrast AKS image, azurelinux. MBR, not supported yet.
+		// 	// Contrast AKS image, azurelinux. MBR, outputs not recorded yet.
 		// 	inFileDigest: "sha256:757d0d6d766f8df076bbce920dcdce19dd43ed3a9136cfba5b7b8ddf0118823f",
 		// 	wantOutFiles: map[string]string{},
 		// },
@@ -58,3 +67,431 @@ func TestUnpart(t *testing.T) {
 		})
 	}
 }
+
+// mbrSector returns a boot record sector with the given partition entries.
+func mbrSector(entries ...mbr.Partition) []byte {
+	b := make([]byte, 512)
+	for i, e := range entries {
+		entry := b[446+16*i:]
+		if e.Bootable {
+			entry[0] = 0x80
+		}
+		entry[4] = byte(e.Type)
+		binary.LittleEndian.PutUint32(entry[8:], e.Start)
+		binary.LittleEndian.PutUint32(entry[12:], e.Size)
+	}
+	b[510], b[511] = 0x55, 0xaa
+	return b
+}
+
+func TestMBRPartitions(t *testing.T) {
+	for _, sectorSize := range []int64{512, 4096} {
+		t.Run(fmt.Sprint(sectorSize), func(t *testing.T) {
+			disk := make([]byte, sectorSize*200)
+			mbrBytes := mbrSector(
+				mbr.Partition{Bootable: true, Type: mbr.Linux, Start: 2, Size: 20},
+				mbr.Partition{Type: mbr.ExtendedLBA, Start: 100, Size: 100},
+			)
+			binary.LittleEndian.PutUint32(mbrBytes[440:], 0x1234abcd)
+			copy(disk, mbrBytes)
+			// The first EBR links to the second, 50 sectors into the extended partition.
+			copy(disk[100*sectorSize:], mbrSector(
+				mbr.Partition{Type: mbr.Linux, Start: 2, Size: 10},
+				mbr.Partition{Type: mbr.ExtendedCHS, Start: 50, Size: 30},
+			))
+			copy(disk[150*sectorSize:], mbrSector(mbr.Partition{Type: mbr.LinuxSwap, Start: 4, Size: 20}))
+
+			table, err := mbr.Read(bytesFile{bytes.NewReader(disk)}, int(sectorSize), int(sectorSize))
+			if err != nil {
+				t.Fatal(err)
+			}
+			partitions, err := mbrPartitions(bytes.NewReader(disk), table, sectorSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			type summary struct {
+				index       int
+				typ         mbr.Type
+				start, size int64
+				uuid        string
+			}
+			var got []summary
+			for _, p := range partitions {
+				got = append(got, summary{p.Index, p.Type, p.GetStart(), p.GetSize(), p.PartUUID})
+			}
+			want := []summary{
+				{1, mbr.Linux, 2 * sectorSize, 20 * sectorSize, "1234abcd-01"},
+				{2, mbr.ExtendedLBA, 100 * sectorSize, 100 * sectorSize, "1234abcd-02"},
+				{5, mbr.Linux, 102 * sectorSize, 10 * sectorSize, "1234abcd-05"},
+				{6, mbr.LinuxSwap, 154 * sectorSize, 20 * sectorSize, "1234abcd-06"},
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got partitions %+v, want %+v", got, want)
+			}
+
+			// A chain linking back to an EBR must not be followed forever.
+			copy(disk[150*sectorSize:], mbrSector(
+				mbr.Partition{Type: mbr.LinuxSwap, Start: 4, Size: 20},
+				mbr.Partition{Type: mbr.ExtendedCHS, Start: 50, Size: 30},
+			))
+			if _, err := mbrPartitions(bytes.NewReader(disk), table, sectorSize); err == nil {
+				t.Error("expected error for looping EBR chain")
+			}
+		})
+	}
+}
+
+// bytesFile is a read-only util.File.
+type bytesFile struct {
+	*bytes.Reader
+}
+
+func (bytesFile) WriteAt([]byte, int64) (int, error) {
+	return 0, errors.New("read-only")
+}
+
+func TestHybridMBRPartitions(t *testing.T) {
+	protective := mbr.Partition{Type: mbr.GPTProtective, Start: 1, Size: 1000}
+	esp := mbr.Partition{Bootable: true, Type: mbr.EFISystem, Start: 2048, Size: 1000}
+
+	testCases := map[string]struct {
+		mbr  []byte
+		want int
+	}{
+		"protective": {mbr: mbrSector(protective)},
+		"hybrid":     {mbr: mbrSector(protective, esp), want: 1},
+		"no gpt":     {mbr: mbrSector(esp)},
+		"no mbr":     {mbr: make([]byte, 512)},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			partitions, err := hybridMBRPartitions(bytes.NewReader(tc.mbr))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(partitions) != tc.want {
+				t.Errorf("got %d hybrid partitions, want %d", len(partitions), tc.want)
+			}
+		})
+	}
+}
+
+// gptDisk returns a disk image of size bytes with a GPT describing partitions.
+func gptDisk(t *testing.T, size int64, partitions ...*gpt.Partition) []byte {
+	f, err := os.CreateTemp(t.TempDir(), "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	table := &gpt.Table{Partitions: partitions, LogicalSectorSize: 512, ProtectiveMBR: true}
+	if err := table.Write(f, size); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// go-diskfs stores the location of the primary partition array in the
+	// backup header as well.
+	backup := b[size-512:]
+	binary.LittleEndian.PutUint64(backup[72:], uint64(size/512-33))
+	clear(backup[16:20])
+	binary.LittleEndian.PutUint32(backup[16:], crc32.ChecksumIEEE(backup[:92]))
+	return b
+}
+
+// setGPTHeaderField sets the 32 bit field at offset of the GPT header at
+// header and updates the header checksum.
+func setGPTHeaderField(header []byte, offset int, value uint32) {
+	binary.LittleEndian.PutUint32(header[offset:], value)
+	clear(header[16:20])
+	binary.LittleEndian.PutUint32(header[16:], crc32.ChecksumIEEE(header[:92]))
+}
+
+func TestVerifyGPT(t *testing.T) {
+	const size = 4 << 20
+	esp := func() *gpt.Partition {
+		return &gpt.Partition{Start: 2048, End: 4095, Type: gpt.EFISystemPartition, Name: "esp"}
+	}
+	root := func() *gpt.Partition {
+		return &gpt.Partition{Start: 4096, End: 8000, Type: gpt.LinuxFilesystem, Name: "root"}
+	}
+
+	testCases := map[string]struct {
+		disk          func(t *testing.T) []byte
+		wantProblems  int
+		wantWarnings  int
+		wantAlignment int64
+	}{
+		"valid": {
+			disk:          func(t *testing.T) []byte { return gptDisk(t, size, esp(), root()) },
+			wantAlignment: 1 << 20,
+		},
+		"unaligned": {
+			disk: func(t *testing.T) []byte {
+				p := root()
+				p.Start = 4097
+				return gptDisk(t, size, esp(), p)
+			},
+			wantWarnings:  1,
+			wantAlignment: 512,
+		},
+		"overlap": {
+			disk: func(t *testing.T) []byte {
+				p := root()
+				p.Start = 4000
+				return gptDisk(t, size, esp(), p)
+			},
+			wantProblems:  1,
+			wantAlignment: 1 << 5 * 512,
+		},
+		"header checksum": {
+			disk: func(t *testing.T) []byte {
+				b := gptDisk(t, size, esp(), root())
+				b[512+40]++
+				return b
+			},
+			// The changed first usable LBA also differs from the backup.
+			wantProblems:  2,
+			wantAlignment: 1 << 20,
+		},
+		"backup partition array": {
+			disk: func(t *testing.T) []byte {
+				b := gptDisk(t, size, esp(), root())
+				b[size-33*512]++
+				return b
+			},
+			wantProblems:  2,
+			wantAlignment: 1 << 20,
+		},
+		"resized": {
+			disk: func(t *testing.T) []byte {
+				return append(gptDisk(t, size, esp(), root()), make([]byte, 1<<20)...)
+			},
+			// The protective MBR, the alternate LBA of the primary header,
+			// the missing and the misplaced backup header.
+			wantProblems:  4,
+			wantAlignment: 1 << 20,
+		},
+		"hybrid": {
+			disk: func(t *testing.T) []byte {
+				b := gptDisk(t, size, esp(), root())
+				copy(b[446+16:], mbrSector(mbr.Partition{Type: mbr.EFISystem, Start: 2048, Size: 2048})[446:462])
+				return b
+			},
+			wantWarnings:  1,
+			wantAlignment: 1 << 20,
+		},
+		"zero entry size": {
+			disk: func(t *testing.T) []byte {
+				b := gptDisk(t, size, esp(), root())
+				setGPTHeaderField(b[512:], 84, 0)
+				return b
+			},
+			// The entry size and its difference to the backup header. The
+			// layout is checked with the backup partition array.
+			wantProblems:  2,
+			wantAlignment: 1 << 20,
+		},
+		"zero entry size in both headers": {
+			disk: func(t *testing.T) []byte {
+				b := gptDisk(t, size, esp(), root())
+				setGPTHeaderField(b[512:], 84, 0)
+				setGPTHeaderField(b[size-512:], 84, 0)
+				return b
+			},
+			wantProblems: 2,
+		},
+		"corrupt header": {
+			disk: func(t *testing.T) []byte {
+				b := gptDisk(t, size, esp(), root())
+				binary.LittleEndian.PutUint32(b[512+84:], 0)
+				return b
+			},
+			// The checksum, the entry size and the difference.
+			wantProblems:  3,
+			wantAlignment: 1 << 20,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			disk := tc.disk(t)
+			report, err := verifyGPT(bytes.NewReader(disk), int64(len(disk)), 512)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Problems) != tc.wantProblems {
+				t.Errorf("got problems %q, want %d", report.Problems, tc.wantProblems)
+			}
+			if len(report.Warnings) != tc.wantWarnings {
+				t.Errorf("got warnings %q, want %d", report.Warnings, tc.wantWarnings)
+			}
+			if report.Alignment != tc.wantAlignment {
+				t.Errorf("got alignment %d, want %d", report.Alignment, tc.wantAlignment)
+			}
+		})
+	}
+}
+
+func TestPartitionTypeName(t *testing.T) {
+	testCases := map[string]string{
+		"C12A7328-F81F-11D2-BA4B-00A0C93EC93B": "esp",
+		"4f68bce3-e8cd-4db1-96e7-fbcaf984b709": "root-x86-64",
+		"2C7357ED-EBD2-46D9-AEC1-23D437EC2BF5": "root-x86-64-verity",
+		"B0E01050-EE5F-4390-949A-9101B17104E9": "usr-arm64",
+		"0FC63DAF-8483-4772-8E79-3D69D8477DE4": "linux-generic",
+		"EBD0A0A2-B9E5-4433-87C0-68B6B72699C7": "",
+	}
+	for guid, want := range testCases {
+		if got := partitionTypeName(guid); got != want {
+			t.Errorf("partitionTypeName(%s) = %q, want %q", guid, got, want)
+		}
+	}
+}
+
+func TestPartitionAttributeNames(t *testing.T) {
+	got := partitionAttributeNames(1<<63 | 1<<60 | 1<<59 | 1<<48 | 1<<2 | 1<<1 | 1)
+	want := []string{"required", "no-block-io", "legacy-bootable", "bit-48", "grow-fs", "read-only", "no-auto"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestVerifyVerityTree(t *testing.T) {
+	// The superblock and root hash of a hash partition of 10 MiB of zeros,
+	// created by systemd-repart.
+	salt, _ := hex.DecodeString("fc2edc7eb09dc73a0521f05c7793a02b7e5b637fd5d914d1d324258fe4ec2438")
+	const wantRootHash = "96bc57964132148b4d25c8739b2d099a726046060bcc4aebfab7a963e0154fae"
+	sb := make([]byte, 512)
+	copy(sb, "verity\x00\x00")
+	binary.LittleEndian.PutUint32(sb[8:], 1)
+	binary.LittleEndian.PutUint32(sb[12:], 1)
+	copy(sb[32:], "sha256")
+	binary.LittleEndian.PutUint32(sb[64:], 512)
+	binary.LittleEndian.PutUint32(sb[68:], 512)
+	binary.LittleEndian.PutUint64(sb[72:], 20480)
+	binary.LittleEndian.PutUint16(sb[80:], uint16(len(salt)))
+	copy(sb[88:], salt)
+
+	// The hash tree of 1366 blocks is left empty, so every level mismatches.
+	hashDev := bytes.NewReader(append(sb, make([]byte, 1366*512)...))
+	parsed, err := readVeritySuperblock(hashDev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Algorithm != "sha256" || parsed.DataBlocks != 20480 || !bytes.Equal(parsed.Salt, salt) {
+		t.Fatalf("unexpected superblock %+v", parsed)
+	}
+
+	rootHash, mismatches, err := verifyVerityTree(bytes.NewReader(make([]byte, 10<<20)), hashDev, parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(rootHash); got != wantRootHash {
+		t.Errorf("got root hash %s, want %s", got, wantRootHash)
+	}
+	wantMismatches := []verityMismatch{
+		{Level: 0, Blocks: 1280, Mismatches: 1280},
+		{Level: 1, Blocks: 80, Mismatches: 80},
+		{Level: 2, Blocks: 5, Mismatches: 5},
+		{Level: 3, Blocks: 1, Mismatches: 1},
+	}
+	if !reflect.DeepEqual(mismatches, wantMismatches) {
+		t.Errorf("got mismatches %+v, want %+v", mismatches, wantMismatches)
+	}
+
+	if _, _, err := verifyVerityTree(bytes.NewReader(make([]byte, 512)), hashDev, parsed); err == nil {
+		t.Error("expected error for truncated data")
+	}
+}
+
+func TestVerifyVerityTreeHashType0(t *testing.T) {
+	// A sha1 tree of hash type 0 over 300 blocks of 512 bytes, block i
+	// filled with byte i. Hash blocks hold 16 digests of 20 bytes, not 25.
+	// The root hash was computed following cryptsetup's VERITY_create.
+	salt, _ := hex.DecodeString("0123456789abcdef0123456789abcdef")
+	const wantRootHash = "1f6d8c10a5deb31e21e29f793eb39b5d36bc71ee"
+	sb := &veritySuperblock{
+		Version:       1,
+		Algorithm:     "sha1",
+		DataBlockSize: 512,
+		HashBlockSize: 512,
+		DataBlocks:    300,
+		Salt:          salt,
+	}
+	data := make([]byte, 300*512)
+	for i := range data {
+		data[i] = byte(i / 512)
+	}
+
+	hashDev := bytes.NewReader(make([]byte, 512+22*512))
+	rootHash, mismatches, err := verifyVerityTree(bytes.NewReader(data), hashDev, sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(rootHash); got != wantRootHash {
+		t.Errorf("got root hash %s, want %s", got, wantRootHash)
+	}
+	wantMismatches := []verityMismatch{
+		{Level: 0, Blocks: 19, Mismatches: 19},
+		{Level: 1, Blocks: 2, Mismatches: 2},
+		{Level: 2, Blocks: 1, Mismatches: 1},
+	}
+	if !reflect.DeepEqual(mismatches, wantMismatches) {
+		t.Errorf("got mismatches %+v, want %+v", mismatches, wantMismatches)
+	}
+}
+
+func TestParseVerityHashes(t *testing.T) {
+	const rootHash = "e824a5de10b8f8f734f0047a9b6f22893ecbc864e1a253dccbc067ac62553ebb"
+	hashes, err := parseVerityHashes("quiet roothash=00 usrhash=" + rootHash + " roothash=" + rootHash + " ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 2 || hashes[0].Kind != "root" || hashes[1].Kind != "usr" {
+		t.Fatalf("parseVerityHashes() = %v, want root and usr hash", hashes)
+	}
+	for _, h := range hashes {
+		if hex.EncodeToString(h.Hash) != rootHash {
+			t.Errorf("%shash = %x, want %s", h.Kind, h.Hash, rootHash)
+		}
+	}
+
+	// The hash of systemd-repart's verity example, with the partition UUIDs
+	// it generated.
+	data, hashPart := verityPartitionUUIDs(hashes[0].Hash)
+	if got, want := data.String(), "e824a5de-10b8-f8f7-34f0-047a9b6f2289"; got != want {
+		t.Errorf("data partition UUID = %s, want %s", got, want)
+	}
+	if got, want := hashPart.String(), "3ecbc864-e1a2-53dc-cbc0-67ac62553ebb"; got != want {
+		t.Errorf("hash partition UUID = %s, want %s", got, want)
+	}
+
+	for _, cmdline := range []string{"roothash=xyz", "usrhash=e824a5de"} {
+		if _, err := parseVerityHashes(cmdline); err == nil {
+			t.Errorf("parseVerityHashes(%q) succeeded, want error", cmdline)
+		}
+	}
+}
+
+func TestArch(t *testing.T) {
+	testCases := []struct {
+		typeName, kind, want string
+	}{
+		{"root-x86-64", "root", "x86-64"},
+		{"root-x86-64-verity", "root", ""},
+		{"root-x86-64-verity", "root-verity", "x86-64"},
+		{"root-x86-64-verity-sig", "root-verity", ""},
+		{"usr-arm64-verity", "usr-verity", "arm64"},
+		{"usr-arm64", "root", ""},
+		{"esp", "root", ""},
+	}
+	for _, tc := range testCases {
+		if got := arch(tc.typeName, tc.kind); got != tc.want {
+			t.Errorf("arch(%q, %q) = %q, want %q", tc.typeName, tc.kind, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/diskfs/go-diskfs/partition/mbr"
+)
+
+const (
+	// mbrRecordSize is the size of the MBR and of extended boot records,
+	// which are at the start of their sector.
+	mbrRecordSize        = 512
+	mbrEntriesStart      = 446
+	mbrEntrySize         = 16
+	mbrEntryCount        = 4
+	mbrFirstLogicalIndex = 5
+	mbrMaxLogical        = 128
+)
+
+// mbrPartition is a partition of an MBR partition table. Index numbers the
+// primary partitions 1 to 4 by their slot and logical partitions from 5 on,
+// like Linux does.
+type mbrPartition struct {
+	*mbr.Partition
+	Index int
+	// PartUUID is the partition UUID as reported by blkid.
+	PartUUID   string
+	sectorSize int64
+}
+
+// GetStart returns the offset of the partition in bytes. Unlike the method of
+// mbr.Partition, it uses the logical sector size of the disk instead of
+// assuming 512 bytes.
+func (p mbrPartition) GetStart() int64 {
+	return int64(p.Start) * p.sectorSize
+}
+
+// GetSize returns the size of the partition in bytes.
+func (p mbrPartition) GetSize() int64 {
+	return int64(p.Size) * p.sectorSize
+}
+
+// isExtended reports whether t is the type of an extended partition, which
+// holds the chain of extended boot records describing logical partitions.
+func isExtended(t mbr.Type) bool {
+	return t == mbr.ExtendedCHS || t == mbr.ExtendedLBA || t == mbr.LinuxExtended
+}
+
+// mbrPartitions returns the non-empty partitions of table, including the
+// logical partitions in extended partitions. Sectors are sectorSize bytes, the
+// logical block size of the disk.
+func mbrPartitions(f io.ReaderAt, table *mbr.Table, sectorSize int64) ([]mbrPartition, error) {
+	var partitions []mbrPartition
+	logicalIndex := mbrFirstLogicalIndex
+	for i, p := range table.Partitions {
+		if p.Type == mbr.Empty {
+			continue
+		}
+		partitions = append(partitions, mbrPartition{Partition: p, Index: i + 1, PartUUID: p.UUID(), sectorSize: sectorSize})
+		if !isExtended(p.Type) {
+			continue
+		}
+		logical, err := readLogicalPartitions(f, p, sectorSize)
+		if err != nil {
+			return nil, fmt.Errorf("reading logical partitions of partition %d: %w", i+1, err)
+		}
+		for _, lp := range logical {
+			partitions = append(partitions, mbrPartition{
+				Partition: lp,
+				Index:     logicalIndex,
+				// blkid numbers logical partitions like the kernel.
+				PartUUID:   fmt.Sprintf("%.33s-%02x", table.UUID(), logicalIndex),
+				sectorSize: sectorSize,
+			})
+			logicalIndex++
+		}
+	}
+	return partitions, nil
+}
+
+// readLogicalPartitions follows the chain of extended boot records (EBR) in
+// the extended partition ext. Each EBR describes a logical partition relative
+// to the EBR itself, and links the next EBR relative to the start of ext.
+func readLogicalPartitions(f io.ReaderAt, ext *mbr.Partition, sectorSize int64) ([]*mbr.Partition, error) {
+	var partitions []*mbr.Partition
+	seen := make(map[uint32]bool)
+	for next := uint32(0); ; {
+		if seen[next] {
+			return nil, fmt.Errorf("extended boot record chain loops at sector %d", ext.Start+next)
+		}
+		if len(seen) >= mbrMaxLogical {
+			return nil, fmt.Errorf("more than %d logical partitions", mbrMaxLogical)
+		}
+		seen[next] = true
+		if next >= ext.Size {
+			return nil, fmt.Errorf("extended boot record at sector %d is outside of the extended partition", ext.Start+next)
+		}
+		ebrStart := ext.Start + next
+
+		b := make([]byte, mbrRecordSize)
+		if _, err := f.ReadAt(b, int64(ebrStart)*sectorSize); err != nil {
+			return nil, fmt.Errorf("reading extended boot record at sector %d: %w", ebrStart, err)
+		}
+		if b[510] != 0x55 || b[511] != 0xaa {
+			return nil, fmt.Errorf("invalid signature of extended boot record at sector %d", ebrStart)
+		}
+		logical := parseMBREntry(b[mbrEntriesStart:])
+		link := parseMBREntry(b[mbrEntriesStart+mbrEntrySize:])
+
+		if logical.Type != mbr.Empty {
+			logical.Start += ebrStart
+			partitions = append(partitions, logical)
+		}
+		if link.Type == mbr.Empty || link.Start == 0 {
+			return partitions, nil
+		}
+		next = link.Start
+	}
+}
+
+// parseMBREntry parses a 16 byte partition entry, ignoring the CHS addresses.
+func parseMBREntry(b []byte) *mbr.Partition {
+	return &mbr.Partition{
+		Bootable: b[0] == 0x80,
+		Type:     mbr.Type(b[4]),
+		Start:    binary.LittleEndian.Uint32(b[8:12]),
+		Size:     binary.LittleEndian.Uint32(b[12:16]),
+	}
+}
+
+// hybridMBRPartitions returns the partitions a hybrid MBR defines next to the
+// protective 0xEE partition of a GPT disk. The MBR of a GPT disk should only
+// protect the disk, partitions defined in both tables can diverge, and
+// firmware or operating systems using the MBR see a different disk.
+func hybridMBRPartitions(f io.ReaderAt) ([]*mbr.Partition, error) {
+	b := make([]byte, mbrRecordSize)
+	if _, err := f.ReadAt(b, 0); err != nil {
+		return nil, fmt.Errorf("reading MBR: %w", err)
+	}
+	if b[510] != 0x55 || b[511] != 0xaa {
+		return nil, nil
+	}
+	var protective bool
+	var partitions []*mbr.Partition
+	for i := range mbrEntryCount {
+		p := parseMBREntry(b[mbrEntriesStart+i*mbrEntrySize:])
+		switch p.Type {
+		case mbr.Empty:
+		case mbr.GPTProtective:
+			protective = true
+		default:
+			partitions = append(partitions, p)
+		}
+	}
+	if !protective {
+		return nil, nil
+	}
+	return partitions, nil
+}
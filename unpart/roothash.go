@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/filesystem/fat32"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/google/uuid"
+)
+
+// ukiDirs are the directories of the ESP searched for UKIs: type #2 boot
+// loader entries and the default boot path of the firmware.
+var ukiDirs = []string{"/EFI/Linux", "/EFI/BOOT"}
+
+// verityHash is a dm-verity root hash from the kernel command line.
+type verityHash struct {
+	// Kind is "root" for roothash= and "usr" for usrhash=.
+	Kind string
+	Hash []byte
+}
+
+// roothash checks that the dm-verity root hashes on the command line of the
+// UKIs on the ESP of the disk at args[0] match the root and usr partitions.
+// Like systemd-repart, the data partition UUID must be the first 128 bits of
+// the root hash and the hash partition UUID the last 128 bits, and the hash
+// tree must produce the root hash.
+func roothash(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s roothash <path>", os.Args[0])
+	}
+	disk, err := diskfs.Open(args[0], diskfs.WithOpenMode(diskfs.ReadOnly))
+	if err != nil {
+		return err
+	}
+	defer disk.File.Close()
+	table, err := disk.GetPartitionTable()
+	if err != nil {
+		return err
+	}
+	gptTable, ok := table.(*gpt.Table)
+	if !ok {
+		return fmt.Errorf("partition table is not GPT")
+	}
+
+	var esp *gpt.Partition
+	for _, p := range gptTable.Partitions {
+		if partitionTypeName(string(p.Type)) == "esp" {
+			esp = p
+			break
+		}
+	}
+	if esp == nil {
+		return fmt.Errorf("no ESP found")
+	}
+	fs, err := fat32.Read(disk.File, int64(esp.Size), int64(esp.Start)*disk.LogicalBlocksize, disk.LogicalBlocksize)
+	if err != nil {
+		return fmt.Errorf("reading ESP: %w", err)
+	}
+	cmdlines, err := readUKICmdlines(fs)
+	if err != nil {
+		return err
+	}
+	if len(cmdlines) == 0 {
+		return fmt.Errorf("no UKI with a .cmdline section found on the ESP")
+	}
+
+	var problems int
+	for _, uki := range cmdlines {
+		fmt.Printf("UKI %s:\n", uki.path)
+		hashes, err := parseVerityHashes(uki.cmdline)
+		if err != nil {
+			return fmt.Errorf("%s: %w", uki.path, err)
+		}
+		if len(hashes) == 0 {
+			fmt.Println("  problem: command line has no roothash= or usrhash=")
+			problems++
+			continue
+		}
+		for _, h := range hashes {
+			fmt.Printf("  %shash: %x\n", h.Kind, h.Hash)
+			found, err := checkVerityHash(disk.File, gptTable, disk.LogicalBlocksize, h)
+			if err != nil {
+				return err
+			}
+			for _, p := range found {
+				fmt.Printf("  problem: %s\n", p)
+			}
+			problems += len(found)
+		}
+	}
+	if problems > 0 {
+		return fmt.Errorf("found %d problems", problems)
+	}
+	fmt.Println("root hashes match the partitions")
+	return nil
+}
+
+// ukiCmdline is the .cmdline section of a UKI.
+type ukiCmdline struct {
+	path    string
+	cmdline string
+}
+
+// readUKICmdlines returns the command lines of the UKIs in ukiDirs of the ESP.
+func readUKICmdlines(fs *fat32.FileSystem) ([]ukiCmdline, error) {
+	var cmdlines []ukiCmdline
+	for _, dir := range ukiDirs {
+		entries, err := fs.ReadDir(dir)
+		if err != nil {
+			// The directories are optional.
+			continue
+		}
+		for _, e := range entries {
+			if e.IsDir() || !strings.EqualFold(path.Ext(e.Name()), ".efi") {
+				continue
+			}
+			p := path.Join(dir, e.Name())
+			f, err := fs.OpenFile(p, os.O_RDONLY)
+			if err != nil {
+				return nil, fmt.Errorf("opening %s: %w", p, err)
+			}
+			data, err := io.ReadAll(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("reading %s: %w", p, err)
+			}
+			cmdline, ok, err := peCmdline(data)
+			if err != nil {
+				return nil, fmt.Errorf("parsing %s: %w", p, err)
+			}
+			if ok {
+				cmdlines = append(cmdlines, ukiCmdline{path: p, cmdline: cmdline})
+			}
+		}
+	}
+	return cmdlines, nil
+}
+
+// peCmdline returns the content of the .cmdline section of a PE file, and
+// whether it has one.
+func peCmdline(data []byte) (string, bool, error) {
+	f, err := pe.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	section := f.Section(".cmdline")
+	if section == nil {
+		return "", false, nil
+	}
+	// The raw data is padded to the file alignment.
+	b, err := io.ReadAll(io.NewSectionReader(section, 0, int64(min(section.VirtualSize, section.Size))))
+	if err != nil {
+		return "", false, err
+	}
+	return strings.TrimRight(string(b), "\x00\n"), true, nil
+}
+
+// parseVerityHashes returns the roothash= and usrhash= parameters of a kernel
+// command line. Like systemd, the last occurrence of a parameter wins.
+func parseVerityHashes(cmdline string) ([]verityHash, error) {
+	var hashes []verityHash
+	for _, kind := range []string{"root", "usr"} {
+		var value string
+		for _, field := range strings.Fields(cmdline) {
+			if v, ok := strings.CutPrefix(field, kind+"hash="); ok {
+				value = v
+			}
+		}
+		if value == "" {
+			continue
+		}
+		hash, err := hex.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %shash=: %w", kind, err)
+		}
+		if len(hash) < 32 {
+			return nil, fmt.Errorf("%shash= of %d bytes is too short to derive partition UUIDs", kind, len(hash))
+		}
+		hashes = append(hashes, verityHash{Kind: kind, Hash: hash})
+	}
+	return hashes, nil
+}
+
+// verityPartitionUUIDs returns the UUIDs systemd-repart derives for the data
+// and hash partitions from a root hash.
+func verityPartitionUUIDs(hash []byte) (data, hashPart uuid.UUID) {
+	copy(data[:], hash[:16])
+	copy(hashPart[:], hash[len(hash)-16:])
+	return data, hashPart
+}
+
+// checkVerityHash checks that the partitions with the UUIDs derived from h
+// exist, are the data and hash partitions of h.Kind, and that their hash tree
+// produces the root hash. It returns the problems found.
+func checkVerityHash(f io.ReaderAt, table *gpt.Table, sectorSize int64, h verityHash) ([]string, error) {
+	dataUUID, hashUUID := verityPartitionUUIDs(h.Hash)
+	var problems []string
+	find := func(id uuid.UUID, role, wantType string) *gpt.Partition {
+		for _, p := range table.Partitions {
+			if !strings.EqualFold(p.GUID, id.String()) {
+				continue
+			}
+			typeName := partitionTypeName(string(p.Type))
+			if arch(typeName, wantType) == "" {
+				problems = append(problems, fmt.Sprintf("%s partition %s with UUID %s has type %s, want %s-<arch>%s",
+					role, p.Name, id, orUnknown(typeName), h.Kind, strings.TrimPrefix(wantType, h.Kind)))
+				return nil
+			}
+			fmt.Printf("  %s partition %s (%s) has UUID %s\n", role, p.Name, typeName, id)
+			return p
+		}
+		problems = append(problems, fmt.Sprintf("no %s partition with UUID %s derived from the %shash", role, id, h.Kind))
+		return nil
+	}
+	data := find(dataUUID, "data", h.Kind)
+	hash := find(hashUUID, "hash", h.Kind+"-verity")
+	if data == nil || hash == nil {
+		return problems, nil
+	}
+	if arch(partitionTypeName(string(data.Type)), h.Kind) != arch(partitionTypeName(string(hash.Type)), h.Kind+"-verity") {
+		problems = append(problems, fmt.Sprintf("data partition %s and hash partition %s are for different architectures", data.Name, hash.Name))
+	}
+
+	dataReader := io.NewSectionReader(f, int64(data.Start)*sectorSize, int64(data.Size))
+	hashReader := io.NewSectionReader(f, int64(hash.Start)*sectorSize, int64(hash.Size))
+	sb, err := readVeritySuperblock(hashReader)
+	if err != nil {
+		return append(problems, fmt.Sprintf("hash partition %s: %v", hash.Name, err)), nil
+	}
+	rootHash, mismatches, err := verifyVerityTree(dataReader, hashReader, sb)
+	if err != nil {
+		return nil, fmt.Errorf("verifying hash tree of %s: %w", hash.Name, err)
+	}
+	for _, m := range mismatches {
+		problems = append(problems, fmt.Sprintf("level %d of the hash tree in %s: %d of %d hash blocks mismatch, first at block %d",
+			m.Level, hash.Name, m.Mismatches, m.Blocks, m.First))
+	}
+	if !bytes.Equal(rootHash, h.Hash) {
+		problems = append(problems, fmt.Sprintf("hash tree of %s over %s produces root hash %x", hash.Name, data.Name, rootHash))
+	} else {
+		fmt.Printf("  hash tree produces the %shash\n", h.Kind)
+	}
+	return problems, nil
+}
+
+// arch returns the architecture of a DPS type name of the given kind, like
+// x86-64 for root-x86-64 and kind root or root-x86-64-verity and kind
+// root-verity, or "" if the type isn't of that kind.
+func arch(typeName, kind string) string {
+	prefix, suffix, _ := strings.Cut(kind, "-")
+	rest, ok := strings.CutPrefix(typeName, prefix+"-")
+	if !ok {
+		return ""
+	}
+	if suffix == "" {
+		// root-x86-64-verity isn't a root partition.
+		if strings.HasSuffix(rest, "-verity") || strings.HasSuffix(rest, "-verity-sig") {
+			return ""
+		}
+		return rest
+	}
+	a, ok := strings.CutSuffix(rest, "-"+suffix)
+	if !ok {
+		return ""
+	}
+	return a
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
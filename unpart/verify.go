@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/google/uuid"
+)
+
+const (
+	gptSignature      = "EFI PART"
+	gptRevision1      = 0x00010000
+	gptMinHeaderSize  = 92
+	gptMinEntrySize   = 128
+	gptMaxEntriesSize = 1 << 20
+)
+
+// gptHeader is a GPT header as stored on disk.
+// https://uefi.org/specs/UEFI/2.10/05_GUID_Partition_Table_Format.html
+type gptHeader struct {
+	Revision       uint32
+	HeaderSize     uint32
+	HeaderCRC      uint32
+	MyLBA          uint64
+	AlternateLBA   uint64
+	FirstUsableLBA uint64
+	LastUsableLBA  uint64
+	DiskGUID       uuid.UUID
+	EntriesLBA     uint64
+	EntryCount     uint32
+	EntrySize      uint32
+	EntriesCRC     uint32
+	// entriesSectors is the number of sectors the partition array occupies.
+	entriesSectors uint64
+}
+
+// gptEntry is a used entry of the GPT partition array.
+type gptEntry struct {
+	Index      int
+	Type       uuid.UUID
+	GUID       uuid.UUID
+	FirstLBA   uint64
+	LastLBA    uint64
+	Attributes uint64
+	Name       string
+}
+
+func (e gptEntry) String() string {
+	return fmt.Sprintf("partition %d (%s)", e.Index, e.Name)
+}
+
+// gptReport is the result of verifying the GPT of a disk. Problems make the
+// disk invalid, warnings describe unusual but valid layouts.
+type gptReport struct {
+	DiskGUID uuid.UUID
+	Revision uint32
+	// Alignment is the largest power of two all partitions start at a
+	// multiple of, in bytes.
+	Alignment int64
+	Problems  []string
+	Warnings  []string
+}
+
+func (r *gptReport) problem(format string, args ...any) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+func (r *gptReport) warning(format string, args ...any) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// verify checks the integrity of the GPT of the disk at args[0].
+func verify(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s verify <path>", os.Args[0])
+	}
+	disk, err := diskfs.Open(args[0], diskfs.WithOpenMode(diskfs.ReadOnly))
+	if err != nil {
+		return err
+	}
+	defer disk.File.Close()
+
+	report, err := verifyGPT(disk.File, disk.Size, disk.LogicalBlocksize)
+	if err != nil {
+		return err
+	}
+	if report.Revision != 0 {
+		fmt.Printf("disk GUID: %s\n", guidString(report.DiskGUID))
+		fmt.Printf("header revision: %d.%d\n", report.Revision>>16, report.Revision&0xffff)
+	}
+	fmt.Printf("sector size: %d bytes\n", disk.LogicalBlocksize)
+	if report.Alignment > 0 {
+		fmt.Printf("partition alignment: %d bytes\n", report.Alignment)
+	}
+	for _, w := range report.Warnings {
+		fmt.Printf("warning: %s\n", w)
+	}
+	for _, p := range report.Problems {
+		fmt.Printf("problem: %s\n", p)
+	}
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("found %d problems in the GPT", len(report.Problems))
+	}
+	fmt.Println("GPT is valid")
+	return nil
+}
+
+// verifyGPT checks the protective MBR, both GPT headers and partition arrays,
+// and the partition layout of a disk of size bytes. Only reading the disk
+// returns an error, problems with the GPT are reported.
+func verifyGPT(f io.ReaderAt, size, sectorSize int64) (*gptReport, error) {
+	report := &gptReport{}
+	if size < 3*sectorSize {
+		report.problem("disk of %d bytes is too small for a GPT", size)
+		return report, nil
+	}
+	lastLBA := uint64(size/sectorSize - 1)
+
+	mbr := make([]byte, sectorSize)
+	if _, err := f.ReadAt(mbr, 0); err != nil {
+		return nil, fmt.Errorf("reading MBR: %w", err)
+	}
+	verifyProtectiveMBR(report, mbr, lastLBA)
+
+	primary, primaryEntries, err := readGPT(f, report, "primary", 1, sectorSize)
+	if err != nil {
+		return nil, err
+	}
+	if primary != nil {
+		report.DiskGUID, report.Revision = primary.DiskGUID, primary.Revision
+		verifyGPTHeader(report, "primary", primary, 1, lastLBA)
+	}
+
+	backup, backupEntries, err := readGPT(f, report, "backup", lastLBA, sectorSize)
+	if err != nil {
+		return nil, err
+	}
+	if backup == nil && primary != nil && primary.AlternateLBA < lastLBA {
+		// Disks that were grown without moving the backup GPT have it
+		// where the primary header points to.
+		if moved, _, err := readGPT(f, &gptReport{}, "backup", primary.AlternateLBA, sectorSize); err == nil && moved != nil {
+			report.problem("backup GPT header is at LBA %d instead of the last LBA %d, the disk was likely resized", primary.AlternateLBA, lastLBA)
+		}
+	}
+	if backup != nil {
+		if primary == nil {
+			report.DiskGUID, report.Revision = backup.DiskGUID, backup.Revision
+		}
+		verifyGPTHeader(report, "backup", backup, lastLBA, 1)
+	}
+
+	if primary != nil && backup != nil {
+		compareGPTHeaders(report, primary, backup)
+		if primaryEntries != nil && backupEntries != nil && !bytes.Equal(primaryEntries, backupEntries) {
+			report.problem("primary and backup partition arrays differ")
+		}
+	}
+
+	// The layout is checked with the first partition array that could be
+	// read.
+	header, raw := primary, primaryEntries
+	if raw == nil {
+		header, raw = backup, backupEntries
+	}
+	if raw == nil {
+		return report, nil
+	}
+	entries := parseGPTEntries(raw, header.EntrySize)
+	verifyGPTLayout(report, header, entries)
+	report.Alignment = gptAlignment(entries, sectorSize)
+	if report.Alignment > 0 && report.Alignment < 4096 {
+		report.warning("partitions are only aligned to %d bytes, which is slow on disks with 4K sectors", report.Alignment)
+	}
+	return report, nil
+}
+
+// verifyProtectiveMBR checks that the MBR protects the whole disk with a
+// single partition of type 0xEE, as GPT requires.
+func verifyProtectiveMBR(report *gptReport, mbr []byte, lastLBA uint64) {
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		report.problem("protective MBR has no boot signature")
+		return
+	}
+	wantSize := uint32(min(lastLBA, 0xffffffff))
+	var protective int
+	var hybrid []string
+	for i := range mbrEntryCount {
+		p := parseMBREntry(mbr[mbrEntriesStart+i*mbrEntrySize:])
+		switch p.Type {
+		case 0:
+		case 0xee:
+			protective++
+			if p.Start != 1 {
+				report.problem("protective MBR partition starts at LBA %d instead of 1", p.Start)
+			}
+			if p.Size != wantSize {
+				report.problem("protective MBR partition covers %d sectors instead of %d", p.Size, wantSize)
+			}
+			if p.Bootable {
+				report.warning("protective MBR partition is marked bootable")
+			}
+		default:
+			hybrid = append(hybrid, fmt.Sprintf("partition %d of type 0x%02x", i+1, byte(p.Type)))
+		}
+	}
+	switch {
+	case protective == 0:
+		report.problem("MBR has no protective partition of type 0xee")
+	case protective > 1:
+		report.problem("MBR has %d protective partitions", protective)
+	case len(hybrid) > 0:
+		report.warning("hybrid MBR with %s next to the protective partition", strings.Join(hybrid, ", "))
+	}
+}
+
+// readGPT reads the GPT header at lba and its partition array. It returns a
+// nil header if there is no valid header at lba, and nil entries if the
+// partition array can't be read.
+func readGPT(f io.ReaderAt, report *gptReport, name string, lba uint64, sectorSize int64) (*gptHeader, []byte, error) {
+	b := make([]byte, sectorSize)
+	if _, err := f.ReadAt(b, int64(lba)*sectorSize); err != nil {
+		return nil, nil, fmt.Errorf("reading %s GPT header: %w", name, err)
+	}
+	if string(b[:8]) != gptSignature {
+		report.problem("no %s GPT header at LBA %d", name, lba)
+		return nil, nil, nil
+	}
+	h := &gptHeader{
+		Revision:       binary.LittleEndian.Uint32(b[8:]),
+		HeaderSize:     binary.LittleEndian.Uint32(b[12:]),
+		HeaderCRC:      binary.LittleEndian.Uint32(b[16:]),
+		MyLBA:          binary.LittleEndian.Uint64(b[24:]),
+		AlternateLBA:   binary.LittleEndian.Uint64(b[32:]),
+		FirstUsableLBA: binary.LittleEndian.Uint64(b[40:]),
+		LastUsableLBA:  binary.LittleEndian.Uint64(b[48:]),
+		DiskGUID:       guidFromBytes(b[56:72]),
+		EntriesLBA:     binary.LittleEndian.Uint64(b[72:]),
+		EntryCount:     binary.LittleEndian.Uint32(b[80:]),
+		EntrySize:      binary.LittleEndian.Uint32(b[84:]),
+		EntriesCRC:     binary.LittleEndian.Uint32(b[88:]),
+	}
+	if h.HeaderSize < gptMinHeaderSize || int64(h.HeaderSize) > sectorSize {
+		report.problem("%s GPT header has invalid size %d", name, h.HeaderSize)
+		return nil, nil, nil
+	}
+	if binary.LittleEndian.Uint32(b[20:]) != 0 {
+		report.problem("reserved field of %s GPT header is not zero", name)
+	}
+	crcInput := bytes.Clone(b[:h.HeaderSize])
+	clear(crcInput[16:20])
+	if sum := crc32.ChecksumIEEE(crcInput); sum != h.HeaderCRC {
+		report.problem("%s GPT header CRC32 is 0x%08x, header stores 0x%08x", name, sum, h.HeaderCRC)
+	}
+
+	if h.EntrySize < gptMinEntrySize || h.EntrySize%gptMinEntrySize != 0 {
+		report.problem("%s GPT header has invalid partition entry size %d", name, h.EntrySize)
+		return h, nil, nil
+	}
+	entriesSize := int64(h.EntryCount) * int64(h.EntrySize)
+	if entriesSize > gptMaxEntriesSize {
+		report.problem("%s partition array of %d bytes is too large", name, entriesSize)
+		return h, nil, nil
+	}
+	h.entriesSectors = uint64((entriesSize + sectorSize - 1) / sectorSize)
+	entries := make([]byte, entriesSize)
+	if _, err := f.ReadAt(entries, int64(h.EntriesLBA)*sectorSize); err != nil {
+		report.problem("reading %s partition array at LBA %d: %v", name, h.EntriesLBA, err)
+		return h, nil, nil
+	}
+	if sum := crc32.ChecksumIEEE(entries); sum != h.EntriesCRC {
+		report.problem("%s partition array CRC32 is 0x%08x, header stores 0x%08x", name, sum, h.EntriesCRC)
+	}
+	return h, entries, nil
+}
+
+// verifyGPTHeader checks the fields of the header at myLBA, whose alternate
+// header is at altLBA.
+func verifyGPTHeader(report *gptReport, name string, h *gptHeader, myLBA, altLBA uint64) {
+	isPrimary := myLBA < altLBA
+	lastLBA := max(myLBA, altLBA)
+	if h.Revision>>16 != gptRevision1>>16 {
+		report.problem("%s GPT header has unsupported revision 0x%08x", name, h.Revision)
+	}
+	if h.MyLBA != myLBA {
+		report.problem("%s GPT header at LBA %d claims to be at LBA %d", name, myLBA, h.MyLBA)
+	}
+	if h.AlternateLBA != altLBA {
+		if isPrimary {
+			report.problem("primary GPT header locates the backup header at LBA %d instead of the last LBA %d", h.AlternateLBA, altLBA)
+		} else {
+			report.problem("backup GPT header locates the primary header at LBA %d instead of 1", h.AlternateLBA)
+		}
+	}
+	if h.FirstUsableLBA > h.LastUsableLBA {
+		report.problem("%s GPT header has first usable LBA %d after last usable LBA %d", name, h.FirstUsableLBA, h.LastUsableLBA)
+	}
+	// The usable space must leave room for both partition arrays.
+	if h.LastUsableLBA+h.entriesSectors >= lastLBA {
+		report.problem("%s GPT header has last usable LBA %d overlapping the backup partition array", name, h.LastUsableLBA)
+	}
+	if isPrimary {
+		if h.EntriesLBA < 2 || h.EntriesLBA+h.entriesSectors > h.FirstUsableLBA {
+			report.problem("primary partition array at LBA %d overlaps the header or the usable LBAs from %d", h.EntriesLBA, h.FirstUsableLBA)
+		}
+	} else {
+		if h.EntriesLBA <= h.LastUsableLBA || h.EntriesLBA+h.entriesSectors > myLBA {
+			report.problem("backup partition array at LBA %d overlaps the usable LBAs up to %d or the header", h.EntriesLBA, h.LastUsableLBA)
+		}
+	}
+}
+
+// compareGPTHeaders checks that the backup header describes the same disk as
+// the primary header.
+func compareGPTHeaders(report *gptReport, primary, backup *gptHeader) {
+	fields := []struct {
+		name            string
+		primary, backup any
+	}{
+		{"revision", primary.Revision, backup.Revision},
+		{"disk GUID", guidString(primary.DiskGUID), guidString(backup.DiskGUID)},
+		{"first usable LBA", primary.FirstUsableLBA, backup.FirstUsableLBA},
+		{"last usable LBA", primary.LastUsableLBA, backup.LastUsableLBA},
+		{"partition entry count", primary.EntryCount, backup.EntryCount},
+		{"partition entry size", primary.EntrySize, backup.EntrySize},
+		{"partition array CRC32", primary.EntriesCRC, backup.EntriesCRC},
+	}
+	for _, f := range fields {
+		if f.primary != f.backup {
+			report.problem("primary and backup GPT headers differ in %s: %v and %v", f.name, f.primary, f.backup)
+		}
+	}
+}
+
+// parseGPTEntries returns the used entries of a partition array. Entries of
+// an invalid size are ignored.
+func parseGPTEntries(b []byte, entrySize uint32) []gptEntry {
+	if entrySize < gptMinEntrySize {
+		return nil
+	}
+	var entries []gptEntry
+	for i := 0; i+int(entrySize) <= len(b); i += int(entrySize) {
+		e := b[i : i+int(entrySize)]
+		typ := guidFromBytes(e[0:16])
+		if typ == uuid.Nil {
+			continue
+		}
+		name := make([]uint16, 0, 36)
+		for j := 56; j+2 <= 128; j += 2 {
+			c := binary.LittleEndian.Uint16(e[j:])
+			if c == 0 {
+				break
+			}
+			name = append(name, c)
+		}
+		entries = append(entries, gptEntry{
+			Index:      i/int(entrySize) + 1,
+			Type:       typ,
+			GUID:       guidFromBytes(e[16:32]),
+			FirstLBA:   binary.LittleEndian.Uint64(e[32:]),
+			LastLBA:    binary.LittleEndian.Uint64(e[40:]),
+			Attributes: binary.LittleEndian.Uint64(e[48:]),
+			Name:       string(utf16.Decode(name)),
+		})
+	}
+	return entries
+}
+
+// verifyGPTLayout checks that the partitions lie within the usable LBAs of h,
+// don't overlap and have unique GUIDs.
+func verifyGPTLayout(report *gptReport, h *gptHeader, entries []gptEntry) {
+	guids := make(map[uuid.UUID]gptEntry)
+	for _, e := range entries {
+		if e.FirstLBA > e.LastLBA {
+			report.problem("%s ends at LBA %d before it starts at LBA %d", e, e.LastLBA, e.FirstLBA)
+		}
+		if e.FirstLBA < h.FirstUsableLBA || e.LastLBA > h.LastUsableLBA {
+			report.problem("%s at LBAs %d-%d is outside of the usable LBAs %d-%d",
+				e, e.FirstLBA, e.LastLBA, h.FirstUsableLBA, h.LastUsableLBA)
+		}
+		if other, ok := guids[e.GUID]; ok {
+			report.problem("%s has the same GUID as %s", e, other)
+		}
+		guids[e.GUID] = e
+	}
+
+	sorted := make([]gptEntry, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].FirstLBA < sorted[j].FirstLBA })
+	for i := 1; i < len(sorted); i++ {
+		// Compare with every earlier partition that may still extend here.
+		for j := i - 1; j >= 0; j-- {
+			if sorted[j].LastLBA >= sorted[i].FirstLBA {
+				report.problem("%s overlaps %s", sorted[j], sorted[i])
+			}
+		}
+	}
+}
+
+// gptAlignment returns the largest power of two, in bytes, that the starts of
+// all partitions are a multiple of, or 0 without partitions.
+func gptAlignment(entries []gptEntry, sectorSize int64) int64 {
+	var alignment int64
+	for _, e := range entries {
+		start := int64(e.FirstLBA) * sectorSize
+		if start == 0 {
+			continue
+		}
+		a := start & -start
+		if alignment == 0 || a < alignment {
+			alignment = a
+		}
+	}
+	return alignment
+}
+
+// guidFromBytes converts a GUID as stored in GPT, with the first three fields
+// in little endian, to a UUID.
+func guidFromBytes(b []byte) uuid.UUID {
+	var u uuid.UUID
+	copy(u[:], b[:16])
+	u[0], u[1], u[2], u[3] = b[3], b[2], b[1], b[0]
+	u[4], u[5] = b[5], b[4]
+	u[6], u[7] = b[7], b[6]
+	return u
+}
+
+// guidString formats a GUID in upper case, like go-diskfs does.
+func guidString(u uuid.UUID) string {
+	return strings.ToUpper(u.String())
+}
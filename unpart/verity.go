@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/bits"
+	"os"
+
+	"github.com/google/uuid"
+)
+
+const (
+	veritySignature     = "verity\x00\x00"
+	veritySuperblockLen = 512
+	verityMaxSalt       = 256
+)
+
+// veritySuperblock is the superblock veritysetup stores at the start of a
+// dm-verity hash device.
+// https://gitlab.com/cryptsetup/cryptsetup/-/wikis/DMVerity
+type veritySuperblock struct {
+	Version uint32
+	// HashType 1 is the normal format, 0 the format used by Chrome OS,
+	// which appends the salt and doesn't pad digests.
+	HashType      uint32
+	UUID          uuid.UUID
+	Algorithm     string
+	DataBlockSize uint32
+	HashBlockSize uint32
+	DataBlocks    uint64
+	Salt          []byte
+}
+
+var verityHashes = map[string]crypto.Hash{
+	"sha1":   crypto.SHA1,
+	"sha256": crypto.SHA256,
+	"sha512": crypto.SHA512,
+}
+
+// verityMismatch describes a level of the hash tree whose blocks on disk
+// don't match the recomputed ones. Level 0 holds the hashes of the data
+// blocks.
+type verityMismatch struct {
+	Level      int
+	Blocks     uint64
+	Mismatches uint64
+	First      uint64
+}
+
+// verity recomputes the dm-verity hash tree of the data partition at args[0]
+// and compares it with the hash partition at args[1].
+func verity(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: %s verity <data> <hash>", os.Args[0])
+	}
+	data, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	hashDev, err := os.Open(args[1])
+	if err != nil {
+		return err
+	}
+	defer hashDev.Close()
+
+	sb, err := readVeritySuperblock(hashDev)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("verity superblock: version %d, hash type %d, uuid %s\n", sb.Version, sb.HashType, sb.UUID)
+	fmt.Printf("  hash algorithm: %s\n", sb.Algorithm)
+	fmt.Printf("  data blocks: %d of %d bytes\n", sb.DataBlocks, sb.DataBlockSize)
+	fmt.Printf("  hash block size: %d bytes\n", sb.HashBlockSize)
+	fmt.Printf("  salt: %x\n", sb.Salt)
+
+	rootHash, mismatches, err := verifyVerityTree(data, hashDev, sb)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("root hash: %x\n", rootHash)
+	for _, m := range mismatches {
+		fmt.Printf("level %d: %d of %d hash blocks mismatch, first at block %d\n", m.Level, m.Mismatches, m.Blocks, m.First)
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("hash tree doesn't match data in %d levels", len(mismatches))
+	}
+	return nil
+}
+
+// readVeritySuperblock reads and validates the superblock at the start of a
+// hash device.
+func readVeritySuperblock(r io.ReaderAt) (*veritySuperblock, error) {
+	b := make([]byte, veritySuperblockLen)
+	if _, err := r.ReadAt(b, 0); err != nil {
+		return nil, fmt.Errorf("reading verity superblock: %w", err)
+	}
+	if string(b[:8]) != veritySignature {
+		return nil, errors.New("no verity superblock found")
+	}
+	sb := &veritySuperblock{
+		Version:       binary.LittleEndian.Uint32(b[8:]),
+		HashType:      binary.LittleEndian.Uint32(b[12:]),
+		Algorithm:     string(bytes.TrimRight(b[32:64], "\x00")),
+		DataBlockSize: binary.LittleEndian.Uint32(b[64:]),
+		HashBlockSize: binary.LittleEndian.Uint32(b[68:]),
+		DataBlocks:    binary.LittleEndian.Uint64(b[72:]),
+	}
+	copy(sb.UUID[:], b[16:32])
+	saltSize := int(binary.LittleEndian.Uint16(b[80:]))
+	if saltSize > verityMaxSalt {
+		return nil, fmt.Errorf("verity salt size %d exceeds %d", saltSize, verityMaxSalt)
+	}
+	sb.Salt = bytes.Clone(b[88 : 88+saltSize])
+
+	if sb.Version != 1 {
+		return nil, fmt.Errorf("unsupported verity superblock version %d", sb.Version)
+	}
+	if sb.HashType > 1 {
+		return nil, fmt.Errorf("unsupported verity hash type %d", sb.HashType)
+	}
+	if _, ok := verityHashes[sb.Algorithm]; !ok {
+		return nil, fmt.Errorf("unsupported verity hash algorithm %q", sb.Algorithm)
+	}
+	for _, size := range []uint32{sb.DataBlockSize, sb.HashBlockSize} {
+		if size < 512 || size > 1<<20 || size&(size-1) != 0 {
+			return nil, fmt.Errorf("invalid verity block size %d", size)
+		}
+	}
+	return sb, nil
+}
+
+// verityHasher hashes blocks with the salt of a superblock.
+type verityHasher struct {
+	h        hash.Hash
+	salt     []byte
+	hashType uint32
+}
+
+func (v *verityHasher) sum(block []byte) []byte {
+	v.h.Reset()
+	if v.hashType == 1 {
+		v.h.Write(v.salt)
+		v.h.Write(block)
+	} else {
+		v.h.Write(block)
+		v.h.Write(v.salt)
+	}
+	return v.h.Sum(nil)
+}
+
+// verifyVerityTree recomputes the hash tree over the data blocks and compares
+// every level with the tree stored in hashDev after the superblock. The root
+// hash is the hash of the single block of the top level. It returns the
+// recomputed root hash and the levels that don't match.
+func verifyVerityTree(data, hashDev io.ReaderAt, sb *veritySuperblock) ([]byte, []verityMismatch, error) {
+	hasher := &verityHasher{h: verityHashes[sb.Algorithm].New(), salt: sb.Salt, hashType: sb.HashType}
+	digestSize := hasher.h.Size()
+	// The normal format pads digests to a power of two.
+	digestStride := digestSize
+	if sb.HashType == 1 {
+		digestStride = 1 << bits.Len(uint(digestSize-1))
+	}
+	hashBlockSize := int64(sb.HashBlockSize)
+	// Like cryptsetup and the kernel, a hash block holds a power of two
+	// hashes, the rest of it is zero.
+	perBlock := uint64(1) << (bits.Len64(uint64(hashBlockSize)/uint64(digestStride)) - 1)
+	digestOffset := func(i uint64) int64 {
+		return int64(i/perBlock)*hashBlockSize + int64(i%perBlock)*int64(digestStride)
+	}
+
+	// Level i holds the hashes of the blocks of level i-1, level 0 those of
+	// the data blocks. The top level, a single block, is stored first.
+	var levelBlocks []uint64
+	for n := sb.DataBlocks; n > 1; {
+		n = (n + perBlock - 1) / perBlock
+		levelBlocks = append(levelBlocks, n)
+	}
+	levelOffsets := make([]int64, len(levelBlocks))
+	// The tree starts at the first hash block after the superblock.
+	offset := (veritySuperblockLen + hashBlockSize - 1) / hashBlockSize * hashBlockSize
+	for i := len(levelBlocks) - 1; i >= 0; i-- {
+		levelOffsets[i] = offset
+		offset += int64(levelBlocks[i]) * hashBlockSize
+	}
+
+	// computed holds the blocks of the current level, digest the last hash
+	// computed, which ends up being the root hash.
+	var computed, digest []byte
+	if len(levelBlocks) > 0 {
+		computed = make([]byte, int64(levelBlocks[0])*hashBlockSize)
+	}
+	dataReader := bufio.NewReaderSize(io.NewSectionReader(data, 0, int64(sb.DataBlocks)*int64(sb.DataBlockSize)), 1<<20)
+	block := make([]byte, sb.DataBlockSize)
+	for i := range sb.DataBlocks {
+		if _, err := io.ReadFull(dataReader, block); err != nil {
+			return nil, nil, fmt.Errorf("reading data block %d: %w", i, err)
+		}
+		digest = hasher.sum(block)
+		if computed != nil {
+			copy(computed[digestOffset(i):], digest)
+		}
+	}
+
+	var mismatches []verityMismatch
+	for level, blocks := range levelBlocks {
+		stored := make([]byte, len(computed))
+		if _, err := hashDev.ReadAt(stored, levelOffsets[level]); err != nil {
+			return nil, nil, fmt.Errorf("reading level %d of the hash tree: %w", level, err)
+		}
+
+		var next []byte
+		if level+1 < len(levelBlocks) {
+			next = make([]byte, int64(levelBlocks[level+1])*hashBlockSize)
+		}
+		m := verityMismatch{Level: level, Blocks: blocks}
+		for i := range blocks {
+			c := computed[int64(i)*hashBlockSize : int64(i+1)*hashBlockSize]
+			if !bytes.Equal(c, stored[int64(i)*hashBlockSize:int64(i+1)*hashBlockSize]) {
+				if m.Mismatches == 0 {
+					m.First = i
+				}
+				m.Mismatches++
+			}
+			digest = hasher.sum(c)
+			if next != nil {
+				copy(next[digestOffset(i):], digest)
+			}
+		}
+		if m.Mismatches > 0 {
+			mismatches = append(mismatches, m)
+		}
+		computed = next
+	}
+	return digest, mismatches, nil
+}